@@ -0,0 +1,16 @@
+// +build darwin freebsd netbsd
+
+package cachita
+
+import (
+    "os"
+    "syscall"
+    "time"
+)
+
+func accessTime(info os.FileInfo) time.Time {
+    if st, ok := info.Sys().(*syscall.Stat_t); ok {
+        return time.Unix(st.Atimespec.Unix())
+    }
+    return info.ModTime()
+}
@@ -0,0 +1,13 @@
+// +build !linux,!openbsd,!dragonfly,!darwin,!freebsd,!netbsd,!windows
+
+package cachita
+
+import (
+    "os"
+    "time"
+)
+
+// accessTime falls back to the modification time where the access time is not known
+func accessTime(info os.FileInfo) time.Time {
+    return info.ModTime()
+}
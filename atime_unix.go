@@ -0,0 +1,16 @@
+// +build linux openbsd dragonfly
+
+package cachita
+
+import (
+    "os"
+    "syscall"
+    "time"
+)
+
+func accessTime(info os.FileInfo) time.Time {
+    if st, ok := info.Sys().(*syscall.Stat_t); ok {
+        return time.Unix(st.Atim.Unix())
+    }
+    return info.ModTime()
+}
@@ -0,0 +1,14 @@
+package cachita
+
+import (
+    "os"
+    "syscall"
+    "time"
+)
+
+func accessTime(info os.FileInfo) time.Time {
+    if d, ok := info.Sys().(*syscall.Win32FileAttributeData); ok {
+        return time.Unix(0, d.LastAccessTime.Nanoseconds())
+    }
+    return info.ModTime()
+}
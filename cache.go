@@ -5,15 +5,18 @@ import (
     "encoding/hex"
     "errors"
     "fmt"
+    "log"
+    "math"
     "reflect"
     "strings"
+    "sync"
     "time"
 )
 
 type (
     Cache interface {
         Get(key string, i interface{}) error
-        Put(key string, i interface{}, ttl time.Duration) error // ttl 0:default ttl, -1: keep forever
+        Put(key string, i interface{}, ttl time.Duration) error // ttl 0:default ttl, Forever: keep forever
         Incr(key string, ttl time.Duration) (int64, error)
         Tag(key string, tags ...string) error
         Exists(key string) bool
@@ -25,24 +28,85 @@ type (
         Data      interface{}
         ExpiredAt time.Time
     }
+    Option  func(*options)
+    options struct {
+        codec      *codec
+        fileDepth  int
+        fileWidth  int
+        sweepBatch int
+        sweepPause time.Duration
+        sweepLock  bool
+        onError    func(err error)
+        metadata   bool
+        dialect    Dialect
+        tagPrune   time.Duration
+        redisConn  RedisConn
+        // redisSpread drops the hash tag of the keys of Redis Cluster caches
+        redisSpread bool
+        err         error
+        // Postgres only
+        sqlUnlogged   bool
+        notifyChannel string
+    }
 )
 
+// Forever is the ttl of the entries kept until they are invalidated, it can be the default ttl of a cache
+const Forever time.Duration = -1
+
+// never is the expiry time of the entries kept forever, the last second SQL databases can store as a date
+var never = time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC)
+
 var (
     ErrNotFound = errors.New("cachita: cache not found")
     ErrExpired  = errors.New("cachita: cache expired")
+    ErrCorrupt  = errors.New("cachita: cache corrupt")
+
+    errNotInteger = errors.New("cachita: the value is not an integer")
 )
 
+func newOptions(opts []Option) (*options, error) {
+    o := &options{
+        codec:      new(codec),
+        fileDepth:  2,
+        fileWidth:  1,
+        dialect:    MySQL,
+        sweepBatch: 1000,
+        sweepPause: 50 * time.Millisecond,
+        tagPrune:   time.Hour,
+        onError: func(err error) {
+            log.Printf("cachita: %v", err)
+        },
+    }
+    for _, opt := range opts {
+        opt(o)
+        if o.err != nil {
+            return nil, o.err
+        }
+    }
+    return o, nil
+}
+
+// WithErrorHandler sets the function called with the errors of background tasks such as deleting
+// expired SQL rows or writing the file index, they are logged by the standard logger by default
+func WithErrorHandler(f func(err error)) Option {
+    return func(o *options) {
+        o.onError = f
+    }
+}
+
 func calculateTtl(ttl, defaultTtl time.Duration) time.Duration {
     if ttl == 0 {
         return defaultTtl
-    } else if ttl == -1 {
-        return 100000 * time.Hour // 11 years
     }
     return ttl
 }
 
 func expiredAt(ttl, defaultTtl time.Duration) time.Time {
-    return time.Now().Add(calculateTtl(ttl, defaultTtl))
+    ttl = calculateTtl(ttl, defaultTtl)
+    if ttl == Forever {
+        return never
+    }
+    return time.Now().Add(ttl)
 }
 
 func IsErrorOk(err error) bool {
@@ -55,16 +119,27 @@ func Id(params ...string) string {
     return hex.EncodeToString(hash[:])
 }
 
-func runEvery(ttl time.Duration, f func()) {
+// runEvery calls f every ttl until stop is called
+func runEvery(ttl time.Duration, f func()) (stop func()) {
     ticker := time.NewTicker(ttl)
+    done := make(chan struct{})
     go func() {
         for {
             select {
             case <-ticker.C:
                 f()
+            case <-done:
+                ticker.Stop()
+                return
             }
         }
     }()
+    var once sync.Once
+    return func() {
+        once.Do(func() {
+            close(done)
+        })
+    }
 }
 
 func inArr(a []string, x string) bool {
@@ -169,6 +244,28 @@ func deReference(v reflect.Value) reflect.Value {
     return v
 }
 
+// integer returns the value of the built-in integers a counter can hold, or of pointers to them. Named integer
+// types are not counters since they may have their own msgpack encoding.
+func integer(i interface{}) (int64, bool) {
+    v := reflect.ValueOf(i)
+    for v.Kind() == reflect.Ptr && !v.IsNil() {
+        v = v.Elem()
+    }
+    if !v.IsValid() || v.Type().PkgPath() != "" {
+        return 0, false
+    }
+    switch v.Kind() {
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+        return v.Int(), true
+    case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+        if v.Uint() > math.MaxInt64 {
+            return 0, false
+        }
+        return int64(v.Uint()), true
+    }
+    return 0, false
+}
+
 func uniqueTags(a []string) (u []string) {
     hs := make(map[string]struct{})
 
@@ -32,6 +32,25 @@ func cacheExpires(c Cache, t *testing.T, ttl, tts time.Duration) {
     }
 }
 
+func cacheForever(c Cache, t *testing.T) {
+    k := fmt.Sprintf("forever%d", rand.Int())
+    isError(c.Put(k, "∞", Forever), t)
+    var d string
+    isError(c.Get(k, &d), t)
+    assert.Equal(t, "∞", d)
+    assert.True(t, c.Exists(k))
+    if s, ok := c.(Statter); ok {
+        m, err := s.Stat(k)
+        isError(err, t)
+        assert.True(t, m.ExpiredAt.IsZero())
+    }
+
+    n, err := c.Incr(k+"n", Forever)
+    isError(err, t)
+    assert.Equal(t, int64(1), n)
+    assert.True(t, c.Exists(k+"n"))
+}
+
 func test(c Cache, k string, s, d interface{}, t assert.TestingT, f ...func(t assert.TestingT, s, d interface{})) {
     k = fmt.Sprintf("%s%d", k, rand.Int())
     disableAssert := isBenchmark(t)
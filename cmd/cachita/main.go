@@ -0,0 +1,198 @@
+// Command cachita inspects and maintains file cache directories created by cachita.NewFileCache.
+//
+// Usage:
+//
+//	cachita -dir /tmp/file-cache list
+//	cachita -dir /tmp/file-cache -keys 1:<hex key> list
+//	cachita -dir /tmp/file-cache show <key>
+//	cachita -dir /tmp/file-cache purge
+//	cachita -dir /tmp/file-cache verify
+//	cachita -dir /tmp/file-cache -ttl 24h rebuild
+//	cachita -dir /tmp/file-cache stats
+package main
+
+import (
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
+    "os"
+    "strconv"
+    "strings"
+    "text/tabwriter"
+    "time"
+
+    "github.com/gadelkareem/cachita"
+)
+
+func main() {
+    var (
+        dir  = flag.String("dir", "", "file cache directory")
+        ttl  = flag.Duration("ttl", 24*time.Hour, "ttl of files missing from the index when rebuilding it")
+        keys = flag.String("keys", "", "comma separated id:hex encryption keys used to read encrypted entries")
+    )
+    flag.Usage = func() {
+        fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s -dir <dir> [flags] list|show <key>|purge|verify|rebuild|stats\n", os.Args[0])
+        flag.PrintDefaults()
+    }
+    flag.Parse()
+    if *dir == "" || flag.NArg() == 0 {
+        flag.Usage()
+        os.Exit(2)
+    }
+
+    // the keys of encrypted entries are sealed with their values
+    var opts []cachita.Option
+    if *keys != "" {
+        k, err := parseKeys(*keys)
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "cachita: %v\n", err)
+            os.Exit(2)
+        }
+        opts = append(opts, cachita.WithEncryption(k...))
+    }
+
+    var err error
+    switch flag.Arg(0) {
+    case "list":
+        err = list(*dir, opts)
+    case "show":
+        err = show(*dir, flag.Arg(1), opts)
+    case "purge":
+        err = purge(*dir)
+    case "verify":
+        err = verify(*dir)
+    case "rebuild":
+        err = cachita.RebuildFileIndex(*dir, *ttl)
+    case "stats":
+        err = stats(*dir, opts)
+    default:
+        flag.Usage()
+        os.Exit(2)
+    }
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "cachita: %v\n", err)
+        os.Exit(1)
+    }
+}
+
+func list(dir string, opts []cachita.Option) error {
+    w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+    fmt.Fprintln(w, "ID\tKEY\tSIZE\tEXPIRES")
+    err := cachita.ScanFileCache(dir, func(e cachita.FileEntry) error {
+        _, err := fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", e.Id, e.Key, e.Size, expires(e))
+        return err
+    }, opts...)
+    if err != nil {
+        return err
+    }
+    return w.Flush()
+}
+
+func show(dir, key string, opts []cachita.Option) error {
+    if key == "" {
+        return errors.New("missing key")
+    }
+
+    id := cachita.Id(key)
+    found := false
+    err := cachita.ScanFileCache(dir, func(e cachita.FileEntry) error {
+        if e.Id != id {
+            return nil
+        }
+        found = true
+        var v interface{}
+        if err := e.Decode(&v, opts...); err != nil {
+            return err
+        }
+        fmt.Printf("key:     %s\nid:      %s\npath:    %s\nsize:    %d\nexpires: %s\n\n", key, e.Id, e.Path, e.Size, expires(e))
+        data, err := json.MarshalIndent(v, "", "  ")
+        if err != nil {
+            fmt.Printf("%#v\n", v)
+            return nil
+        }
+        fmt.Println(string(data))
+        return nil
+    }, opts...)
+    if err == nil && !found {
+        err = cachita.ErrNotFound
+    }
+    return err
+}
+
+func expires(e cachita.FileEntry) string {
+    if !e.Indexed() {
+        return "not indexed"
+    }
+    if e.Expired() {
+        return e.ExpiredAt.Format(time.RFC3339) + " (expired)"
+    }
+    return e.ExpiredAt.Format(time.RFC3339)
+}
+
+func purge(dir string) error {
+    n, err := cachita.PurgeFileCache(dir)
+    if err != nil {
+        return err
+    }
+    fmt.Printf("purged %d expired entries\n", n)
+    return nil
+}
+
+func verify(dir string) error {
+    missing, unindexed, err := cachita.VerifyFileIndex(dir)
+    if err != nil {
+        return err
+    }
+    for _, id := range missing {
+        fmt.Printf("missing file:    %s\n", id)
+    }
+    for _, id := range unindexed {
+        fmt.Printf("not indexed:     %s\n", id)
+    }
+    if len(missing) > 0 || len(unindexed) > 0 {
+        return fmt.Errorf("index is out of sync, %d missing files, %d files not indexed", len(missing), len(unindexed))
+    }
+    fmt.Println("index ok")
+    return nil
+}
+
+func stats(dir string, opts []cachita.Option) error {
+    var entries, expired, unindexed, size int64
+    err := cachita.ScanFileCache(dir, func(e cachita.FileEntry) error {
+        entries++
+        size += e.Size
+        if e.Expired() {
+            expired++
+        }
+        if !e.Indexed() {
+            unindexed++
+        }
+        return nil
+    }, opts...)
+    if err != nil {
+        return err
+    }
+    fmt.Printf("entries:     %d\nexpired:     %d\nnot indexed: %d\nsize:        %d bytes\n", entries, expired, unindexed, size)
+    return nil
+}
+
+func parseKeys(s string) (keys []cachita.EncryptionKey, err error) {
+    for _, k := range strings.Split(s, ",") {
+        parts := strings.SplitN(k, ":", 2)
+        if len(parts) != 2 {
+            return nil, fmt.Errorf("invalid key %q", k)
+        }
+        id, err := strconv.ParseUint(parts[0], 10, 32)
+        if err != nil {
+            return nil, err
+        }
+        key, err := hex.DecodeString(parts[1])
+        if err != nil {
+            return nil, err
+        }
+        keys = append(keys, cachita.EncryptionKey{Id: uint32(id), Key: key})
+    }
+    return
+}
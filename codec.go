@@ -0,0 +1,398 @@
+package cachita
+
+import (
+    "bytes"
+    "compress/flate"
+    "compress/gzip"
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/rand"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "hash/crc32"
+    "io"
+    "io/ioutil"
+    "sync"
+    "sync/atomic"
+
+    "github.com/vmihailenco/msgpack"
+)
+
+// payloads written by the codec start with 0xc1 which is never used by msgpack,
+// anything else is treated as a raw msgpack payload written by older versions
+const payloadMagic byte = 0xc1
+
+const (
+    flagCompressed byte = 1 << iota
+    flagEncrypted
+    flagChecksum
+    flagKey
+    // flagSealedKey stores the key at the start of the encrypted body instead of the header
+    flagSealedKey
+)
+
+// Compressor compresses serialized payloads, its Id is stored in the payload header
+// so it has to be unique and stable. Ids below 16 are reserved for cachita.
+type Compressor interface {
+    Id() byte
+    Compress(data []byte) ([]byte, error)
+    Decompress(data []byte) ([]byte, error)
+}
+
+var (
+    Gzip  Compressor = gzipCompressor{}
+    Flate Compressor = flateCompressor{}
+
+    compressorsMu sync.RWMutex
+    compressors   = make(map[byte]Compressor)
+
+    crcTable     = crc32.MakeTable(crc32.Castagnoli)
+    corruptReads int64
+)
+
+func init() {
+    RegisterCompressor(Gzip)
+    RegisterCompressor(Flate)
+}
+
+// RegisterCompressor makes a compressor available for reading payloads,
+// it panics if a compressor with the same id is already registered
+func RegisterCompressor(c Compressor) {
+    compressorsMu.Lock()
+    defer compressorsMu.Unlock()
+    if _, exists := compressors[c.Id()]; exists {
+        panic(fmt.Sprintf("cachita: compressor %d already registered", c.Id()))
+    }
+    compressors[c.Id()] = c
+}
+
+func compressor(id byte) (Compressor, error) {
+    compressorsMu.RLock()
+    defer compressorsMu.RUnlock()
+    c, exists := compressors[id]
+    if !exists {
+        return nil, fmt.Errorf("cachita: unknown compressor %d", id)
+    }
+    return c, nil
+}
+
+// WithCompression compresses payloads of at least threshold bytes
+func WithCompression(c Compressor, threshold int) Option {
+    return func(o *options) {
+        o.codec.compressor = c
+        o.codec.threshold = threshold
+    }
+}
+
+// EncryptionKey is an AES-128, AES-192 or AES-256 key, its Id is stored with every payload
+type EncryptionKey struct {
+    Id  uint32
+    Key []byte
+}
+
+// WithEncryption encrypts payloads with AES-GCM using the first key, the remaining keys
+// are only used to decrypt payloads written before the keys were rotated. The keys stored in
+// cache files are encrypted with their values, so listing the keys of an encrypted file cache
+// decrypts its files and ScanFileCache needs the options to report them. The keys of SQL caches
+// created WithMetadata and the counters of Incr are stored in plain text.
+func WithEncryption(keys ...EncryptionKey) Option {
+    return func(o *options) {
+        if len(keys) == 0 {
+            o.err = errors.New("cachita: no encryption key")
+            return
+        }
+        o.codec.keyId = keys[0].Id
+        o.codec.keys = make(map[uint32]cipher.AEAD)
+        for _, k := range keys {
+            block, err := aes.NewCipher(k.Key)
+            if err != nil {
+                o.err = err
+                return
+            }
+            o.codec.keys[k.Id], err = cipher.NewGCM(block)
+            if err != nil {
+                o.err = err
+                return
+            }
+        }
+    }
+}
+
+// WithChecksum appends a CRC32C checksum to every payload, payloads failing
+// the check are reported as ErrCorrupt
+func WithChecksum() Option {
+    return func(o *options) {
+        o.codec.checksum = true
+    }
+}
+
+// WithInvalidateCorrupt removes entries returning ErrCorrupt on Get so they can be repopulated
+func WithInvalidateCorrupt() Option {
+    return func(o *options) {
+        o.codec.invalidateCorrupt = true
+    }
+}
+
+// CorruptReads returns the number of payloads reported as ErrCorrupt since the process started
+func CorruptReads() int64 {
+    return atomic.LoadInt64(&corruptReads)
+}
+
+func corrupt() error {
+    atomic.AddInt64(&corruptReads, 1)
+    return ErrCorrupt
+}
+
+type codec struct {
+    compressor        Compressor
+    threshold         int
+    keys              map[uint32]cipher.AEAD
+    keyId             uint32
+    checksum          bool
+    invalidateCorrupt bool
+}
+
+// marshal serializes i, a non empty key is stored in plain text in the payload header or sealed with
+// the value when the codec encrypts
+func (c *codec) marshal(key string, i interface{}) ([]byte, error) {
+    data, err := msgpack.Marshal(i)
+    if err != nil {
+        return nil, err
+    }
+    if key == "" && c.compressor == nil && c.keys == nil && !c.checksum {
+        return data, nil
+    }
+
+    header := []byte{payloadMagic, 0}
+    if key != "" && c.keys == nil {
+        header[1] |= flagKey
+        header = appendKey(header, key)
+    }
+    if c.compressor != nil && len(data) >= c.threshold {
+        data, err = c.compressor.Compress(data)
+        if err != nil {
+            return nil, err
+        }
+        header[1] |= flagCompressed
+        header = append(header, c.compressor.Id())
+    }
+    if c.checksum {
+        header[1] |= flagChecksum
+    }
+    if c.keys != nil {
+        header[1] |= flagEncrypted
+        header = append(header, 0, 0, 0, 0)
+        binary.BigEndian.PutUint32(header[len(header)-4:], c.keyId)
+        if key != "" {
+            header[1] |= flagSealedKey
+            data = append(appendKey(nil, key), data...)
+        }
+        aead := c.keys[c.keyId]
+        nonce := make([]byte, aead.NonceSize())
+        if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+            return nil, err
+        }
+        // the header is authenticated so flags can not be tampered with
+        data = aead.Seal(nonce, nonce, data, header)
+    }
+    data = append(header, data...)
+    if c.checksum {
+        data = append(data, 0, 0, 0, 0)
+        binary.BigEndian.PutUint32(data[len(data)-4:], crc32.Checksum(data[:len(data)-4], crcTable))
+    }
+    return data, nil
+}
+
+func (c *codec) encrypts() bool {
+    return c.keys != nil
+}
+
+func (c *codec) unmarshal(data []byte, i interface{}) error {
+    _, data, err := c.decode(data)
+    if err != nil {
+        return err
+    }
+    return msgpack.Unmarshal(data, i)
+}
+
+// decode returns the key stored with the payload and the msgpack encoded value
+func (c *codec) decode(data []byte) (string, []byte, error) {
+    if len(data) == 0 || data[0] != payloadMagic {
+        return "", data, nil
+    }
+    h, data, err := readHeader(data)
+    if err != nil {
+        return "", nil, err
+    }
+    if h.flags&flagEncrypted != 0 {
+        aead, exists := c.keys[h.keyId]
+        if !exists {
+            return "", nil, fmt.Errorf("cachita: unknown encryption key %d", h.keyId)
+        }
+        header, body := data[:h.size], data[h.size:]
+        if len(body) < aead.NonceSize() {
+            return "", nil, corrupt()
+        }
+        data, err = aead.Open(nil, body[:aead.NonceSize()], body[aead.NonceSize():], header)
+        if err != nil {
+            return "", nil, corrupt()
+        }
+        if h.flags&flagSealedKey != 0 {
+            if h.key, data, err = readKey(data); err != nil {
+                return "", nil, err
+            }
+        }
+    } else {
+        data = data[h.size:]
+    }
+    if h.flags&flagCompressed != 0 {
+        cmp, err := compressor(h.compressor)
+        if err != nil {
+            return "", nil, err
+        }
+        data, err = cmp.Decompress(data)
+        if err != nil {
+            return "", nil, corrupt()
+        }
+    }
+    return h.key, data, nil
+}
+
+type header struct {
+    flags      byte
+    key        string
+    compressor byte
+    keyId      uint32
+    size       int
+}
+
+// readHeader parses the header of a payload starting with payloadMagic and returns the payload without its checksum
+func readHeader(data []byte) (h header, _ []byte, err error) {
+    if len(data) < 2 {
+        return h, nil, corrupt()
+    }
+    h.flags = data[1]
+    h.size = 2
+    if h.flags&flagChecksum != 0 {
+        if len(data) < h.size+4 {
+            return h, nil, corrupt()
+        }
+        sum := binary.BigEndian.Uint32(data[len(data)-4:])
+        data = data[:len(data)-4]
+        if crc32.Checksum(data, crcTable) != sum {
+            return h, nil, corrupt()
+        }
+    }
+    if h.flags&flagKey != 0 {
+        var rest []byte
+        if h.key, rest, err = readKey(data[h.size:]); err != nil {
+            return h, nil, err
+        }
+        h.size = len(data) - len(rest)
+    }
+    if h.flags&flagCompressed != 0 {
+        if len(data) < h.size+1 {
+            return h, nil, corrupt()
+        }
+        h.compressor = data[h.size]
+        h.size++
+    }
+    if h.flags&flagEncrypted != 0 {
+        if len(data) < h.size+4 {
+            return h, nil, corrupt()
+        }
+        h.keyId = binary.BigEndian.Uint32(data[h.size:])
+        h.size += 4
+    }
+    return h, data, nil
+}
+
+// key returns the key stored with the payload, it is empty for the payloads of older versions and for
+// sealed keys when the codec does not have their encryption key
+func (c *codec) key(data []byte) (string, error) {
+    if len(data) == 0 || data[0] != payloadMagic {
+        return "", nil
+    }
+    h, _, err := readHeader(data)
+    if err != nil || h.flags&flagSealedKey == 0 {
+        return h.key, err
+    }
+    if _, exists := c.keys[h.keyId]; !exists {
+        return "", nil
+    }
+    key, _, err := c.decode(data)
+    return key, err
+}
+
+// appendKey appends the length of key and key to b
+func appendKey(b []byte, key string) []byte {
+    var l [binary.MaxVarintLen64]byte
+    n := binary.PutUvarint(l[:], uint64(len(key)))
+    return append(append(b, l[:n]...), key...)
+}
+
+// readKey reads a key written by appendKey and returns the data following it
+func readKey(data []byte) (string, []byte, error) {
+    l, n := binary.Uvarint(data)
+    if n <= 0 || uint64(len(data)-n) < l {
+        return "", nil, corrupt()
+    }
+    return string(data[n : n+int(l)]), data[n+int(l):], nil
+}
+
+// ----------------------- compressors
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) Id() byte {
+    return 1
+}
+
+func (gzipCompressor) Compress(data []byte) ([]byte, error) {
+    var b bytes.Buffer
+    w := gzip.NewWriter(&b)
+    if _, err := w.Write(data); err != nil {
+        return nil, err
+    }
+    if err := w.Close(); err != nil {
+        return nil, err
+    }
+    return b.Bytes(), nil
+}
+
+func (gzipCompressor) Decompress(data []byte) ([]byte, error) {
+    r, err := gzip.NewReader(bytes.NewReader(data))
+    if err != nil {
+        return nil, err
+    }
+    defer r.Close()
+    return ioutil.ReadAll(r)
+}
+
+type flateCompressor struct{}
+
+func (flateCompressor) Id() byte {
+    return 2
+}
+
+func (flateCompressor) Compress(data []byte) ([]byte, error) {
+    var b bytes.Buffer
+    w, err := flate.NewWriter(&b, flate.DefaultCompression)
+    if err != nil {
+        return nil, err
+    }
+    if _, err = w.Write(data); err != nil {
+        return nil, err
+    }
+    if err = w.Close(); err != nil {
+        return nil, err
+    }
+    return b.Bytes(), nil
+}
+
+func (flateCompressor) Decompress(data []byte) ([]byte, error) {
+    r := flate.NewReader(bytes.NewReader(data))
+    defer r.Close()
+    return ioutil.ReadAll(r)
+}
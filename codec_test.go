@@ -0,0 +1,165 @@
+package cachita
+
+import (
+    "bytes"
+    "strings"
+    "testing"
+
+    "github.com/stretchr/testify/assert"
+    "github.com/vmihailenco/msgpack"
+)
+
+func TestCodecCompression(t *testing.T) {
+    t.Parallel()
+    s := strings.Repeat("<div>(◕‿◕)</div>", 100)
+    for _, cmp := range []Compressor{Gzip, Flate} {
+        c := newCodec(t, WithCompression(cmp, 64))
+        data, err := c.marshal("", s)
+        isError(err, t)
+        assert.Equal(t, payloadMagic, data[0])
+        assert.Equal(t, flagCompressed, data[1]&flagCompressed)
+        assert.Equal(t, cmp.Id(), data[2])
+        assert.True(t, len(data) < len(s))
+
+        var d string
+        isError(c.unmarshal(data, &d), t)
+        assert.Equal(t, s, d)
+    }
+}
+
+func TestCodecBelowThreshold(t *testing.T) {
+    t.Parallel()
+    c := newCodec(t, WithCompression(Gzip, 1024))
+    data, err := c.marshal("", "(◕‿◕)")
+    isError(err, t)
+    assert.Equal(t, payloadMagic, data[0])
+    assert.Equal(t, byte(0), data[1]&flagCompressed)
+
+    var d string
+    isError(c.unmarshal(data, &d), t)
+    assert.Equal(t, "(◕‿◕)", d)
+}
+
+func TestCodecReadsRawMsgpack(t *testing.T) {
+    t.Parallel()
+    data, err := msgpack.Marshal(map[string]interface{}{"a": "b"})
+    isError(err, t)
+    c := newCodec(t, WithCompression(Gzip, 0))
+    var d map[string]interface{}
+    isError(c.unmarshal(data, &d), t)
+    assert.Equal(t, "b", d["a"])
+}
+
+func TestCodecUnknownCompressor(t *testing.T) {
+    t.Parallel()
+    c := newCodec(t)
+    var d string
+    assert.Error(t, c.unmarshal([]byte{payloadMagic, flagCompressed, 255, 1, 2}, &d))
+}
+
+func TestCodecEncryption(t *testing.T) {
+    t.Parallel()
+    key := EncryptionKey{Id: 7, Key: bytes.Repeat([]byte{1}, 32)}
+    c := newCodec(t, WithEncryption(key), WithCompression(Gzip, 0))
+    s := strings.Repeat("ssn:123-45-6789 ", 10)
+    data, err := c.marshal("", s)
+    isError(err, t)
+    assert.Equal(t, flagEncrypted|flagCompressed, data[1])
+    assert.False(t, bytes.Contains(data, []byte("ssn")))
+
+    var d string
+    isError(c.unmarshal(data, &d), t)
+    assert.Equal(t, s, d)
+
+    data[len(data)-1] ^= 1
+    assert.Equal(t, ErrCorrupt, c.unmarshal(data, &d))
+}
+
+func TestCodecKeyRotation(t *testing.T) {
+    t.Parallel()
+    oldKey := EncryptionKey{Id: 1, Key: bytes.Repeat([]byte{1}, 16)}
+    newKey := EncryptionKey{Id: 2, Key: bytes.Repeat([]byte{2}, 16)}
+    old := newCodec(t, WithEncryption(oldKey))
+    data, err := old.marshal("", "(◕‿◕)")
+    isError(err, t)
+
+    var d string
+    rotated := newCodec(t, WithEncryption(newKey, oldKey))
+    isError(rotated.unmarshal(data, &d), t)
+    assert.Equal(t, "(◕‿◕)", d)
+
+    data, err = rotated.marshal("", "(◕‿◕)")
+    isError(err, t)
+    assert.Error(t, old.unmarshal(data, &d))
+    assert.Error(t, newCodec(t).unmarshal(data, &d))
+}
+
+func TestCodecChecksum(t *testing.T) {
+    t.Parallel()
+    c := newCodec(t, WithChecksum())
+    data, err := c.marshal("", "(◕‿◕)")
+    isError(err, t)
+    assert.Equal(t, flagChecksum, data[1])
+
+    var d string
+    isError(c.unmarshal(data, &d), t)
+    assert.Equal(t, "(◕‿◕)", d)
+
+    n := CorruptReads()
+    data[3] ^= 1
+    assert.Equal(t, ErrCorrupt, c.unmarshal(data, &d))
+    assert.True(t, CorruptReads() > n)
+    assert.Equal(t, ErrCorrupt, c.unmarshal(data[:3], &d))
+}
+
+func TestCodecStoresKey(t *testing.T) {
+    t.Parallel()
+    c := newCodec(t, WithChecksum(), WithCompression(Gzip, 0))
+    data, err := c.marshal("user:42", "(◕‿◕)")
+    isError(err, t)
+    h, _, err := readHeader(data)
+    isError(err, t)
+    assert.Equal(t, "user:42", h.key)
+
+    key, body, err := c.decode(data)
+    isError(err, t)
+    assert.Equal(t, "user:42", key)
+    var d string
+    isError(msgpack.Unmarshal(body, &d), t)
+    assert.Equal(t, "(◕‿◕)", d)
+}
+
+func TestCodecSealsKey(t *testing.T) {
+    t.Parallel()
+    encryption := WithEncryption(EncryptionKey{Id: 3, Key: bytes.Repeat([]byte{3}, 32)})
+    c := newCodec(t, encryption, WithCompression(Gzip, 0))
+    data, err := c.marshal("user:jane@x.com", "(◕‿◕)")
+    isError(err, t)
+    assert.False(t, bytes.Contains(data, []byte("jane@x.com")), "the key should not be readable")
+    assert.Equal(t, flagSealedKey, data[1]&(flagKey|flagSealedKey))
+
+    key, err := c.key(data)
+    isError(err, t)
+    assert.Equal(t, "user:jane@x.com", key)
+    var d string
+    isError(c.unmarshal(data, &d), t)
+    assert.Equal(t, "(◕‿◕)", d)
+
+    key, err = newCodec(t).key(data)
+    isError(err, t)
+    assert.Empty(t, key)
+}
+
+func TestCodecInvalidKey(t *testing.T) {
+    t.Parallel()
+    _, err := newOptions([]Option{WithEncryption(EncryptionKey{Id: 1, Key: []byte("short")})})
+    assert.Error(t, err)
+    _, err = newOptions([]Option{WithEncryption()})
+    assert.Error(t, err)
+}
+
+func newCodec(t *testing.T, opts ...Option) *codec {
+    o, err := newOptions(opts)
+    isError(err, t)
+    return o.codec
+}
@@ -0,0 +1,306 @@
+package cachita
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+)
+
+// Dialect generates the SQL statements that differ between databases
+type Dialect interface {
+    // Placeholder returns the bind parameter of the nth argument starting at 1
+    Placeholder(n int) string
+    // Quote quotes an identifier
+    Quote(identifier string) string
+    // BlobType returns the column type of binary data
+    BlobType() string
+    // CreateTable returns the statements creating a table and its indexes if they do not exist,
+    // columns are full column definitions and each index is a list of columns
+    CreateTable(table string, columns []string, indexes ...[]string) []string
+    // CreateIndex returns a statement creating an index of a table
+    CreateIndex(table string, columns ...string) string
+    // Upsert returns a statement inserting a row or updating columns of the row conflicting on the key columns
+    Upsert(table string, key []string, columns ...string) string
+    // Incr returns a statement incrementing the counter of the row if it has not expired or inserting it with
+    // a counter of 1, its arguments are the id, data, expiry of a new row and the current time. The statement
+    // returns the new counter unless last is set, then last returns it on the same connection.
+    Incr(table string) (query, last string)
+    // Limit returns a clause limiting the number of returned rows
+    Limit(n int) string
+    // Columns returns a query listing the name and type of the columns of the table given as its argument,
+    // it returns no rows when the table does not exist
+    Columns() string
+    // AlterColumn returns the statements changing the type of a column, none when the database does not enforce it
+    AlterColumn(table, column, columnType string, notNull bool) []string
+    // Lock returns the statements taking and releasing a lock named by their argument and held by the connection,
+    // lock returns whether the lock was taken and only waits for it when wait is set. They are empty when the
+    // database has no named locks.
+    Lock(wait bool) (lock, unlock string)
+}
+
+var (
+    Postgres Dialect = postgres{}
+    MySQL    Dialect = mysql{}
+    SQLite   Dialect = sqlite{}
+)
+
+// WithDialect sets the Dialect of SQL caches
+func WithDialect(d Dialect) Option {
+    return func(o *options) {
+        o.dialect = d
+    }
+}
+
+// dialect guesses the dialect from the driver name, defaulting to MySQL
+func dialect(driverName, dataSourceName string) Dialect {
+    switch {
+    case driverName == "postgres" || driverName == "pgx" || strings.Contains(dataSourceName, "postgres"):
+        return Postgres
+    case driverName == "sqlite" || driverName == "sqlite3":
+        return SQLite
+    }
+    return MySQL
+}
+
+type postgres struct{}
+
+func (postgres) Placeholder(n int) string {
+    return "$" + strconv.Itoa(n)
+}
+
+func (postgres) Quote(identifier string) string {
+    return quote(identifier, `"`)
+}
+
+func (postgres) BlobType() string {
+    return "BYTEA"
+}
+
+func (d postgres) CreateTable(table string, columns []string, indexes ...[]string) []string {
+    return createTable(d, table, columns, indexes)
+}
+
+func (d postgres) CreateIndex(table string, columns ...string) string {
+    return "CREATE INDEX IF NOT EXISTS " + index(d, table, columns)
+}
+
+func (d postgres) Upsert(table string, key []string, columns ...string) string {
+    return upsert(d, table, key, columns)
+}
+
+func (d postgres) Incr(table string) (string, string) {
+    return incrReturning(d, table), ""
+}
+
+func (postgres) Limit(n int) string {
+    return "LIMIT " + strconv.Itoa(n)
+}
+
+func (postgres) Columns() string {
+    return "SELECT column_name, data_type FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = $1"
+}
+
+func (d postgres) AlterColumn(table, column, columnType string, notNull bool) []string {
+    null := "DROP NOT NULL"
+    if notNull {
+        null = "SET NOT NULL"
+    }
+    return []string{fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s TYPE %s, ALTER COLUMN %s %s", d.Quote(table), d.Quote(column), columnType, d.Quote(column), null)}
+}
+
+// Lock uses session advisory locks keyed by the hash of the name
+func (postgres) Lock(wait bool) (string, string) {
+    unlock := "SELECT pg_advisory_unlock(hashtext($1))"
+    if wait {
+        return "SELECT true FROM pg_advisory_lock(hashtext($1))", unlock
+    }
+    return "SELECT pg_try_advisory_lock(hashtext($1))", unlock
+}
+
+type mysql struct{}
+
+func (mysql) Placeholder(n int) string {
+    return "?"
+}
+
+func (mysql) Quote(identifier string) string {
+    return quote(identifier, "`")
+}
+
+func (mysql) BlobType() string {
+    return "LONGBLOB"
+}
+
+// CreateTable declares the indexes in the table definition since MySQL has no CREATE INDEX IF NOT EXISTS
+func (d mysql) CreateTable(table string, columns []string, indexes ...[]string) []string {
+    for _, index := range indexes {
+        columns = append(columns, fmt.Sprintf("INDEX %s (%s)", d.Quote(indexName(table, index)), quoteAll(d, index)))
+    }
+    return []string{fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", d.Quote(table), strings.Join(columns, ", "))}
+}
+
+// CreateIndex fails when the index exists, MySQL has no CREATE INDEX IF NOT EXISTS
+func (d mysql) CreateIndex(table string, columns ...string) string {
+    return "CREATE INDEX " + index(d, table, columns)
+}
+
+func (d mysql) Upsert(table string, key []string, columns ...string) string {
+    var set []string
+    for _, c := range columns {
+        if !inArr(key, c) {
+            set = append(set, fmt.Sprintf("%s = VALUES(%s)", d.Quote(c), d.Quote(c)))
+        }
+    }
+    if len(set) == 0 {
+        set = append(set, fmt.Sprintf("%s = %s", d.Quote(key[0]), d.Quote(key[0])))
+    }
+    return fmt.Sprintf("%s ON DUPLICATE KEY UPDATE %s", insert(d, table, columns), strings.Join(set, ", "))
+}
+
+// Incr uses LAST_INSERT_ID(expr) to keep the counter for the connection as MySQL has no RETURNING,
+// the expiry is only reset when the counter restarts at 1 since the current time can only be bound once
+func (d mysql) Incr(table string) (string, string) {
+    query := "INSERT INTO " + d.Quote(table) + " (id, data, counter, expired_at) VALUES (?, ?, LAST_INSERT_ID(1), ?) " +
+        "ON DUPLICATE KEY UPDATE counter = LAST_INSERT_ID(IF(expired_at > ?, COALESCE(counter, 0) + 1, 1)), " +
+        "expired_at = IF(counter = 1, VALUES(expired_at), expired_at)"
+    return query, "SELECT LAST_INSERT_ID()"
+}
+
+func (mysql) Limit(n int) string {
+    return "LIMIT " + strconv.Itoa(n)
+}
+
+func (mysql) Columns() string {
+    return "SELECT column_name, data_type FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = ?"
+}
+
+func (d mysql) AlterColumn(table, column, columnType string, notNull bool) []string {
+    if notNull {
+        columnType += " NOT NULL"
+    }
+    return []string{fmt.Sprintf("ALTER TABLE %s MODIFY %s %s", d.Quote(table), d.Quote(column), columnType)}
+}
+
+// Lock uses GET_LOCK, a negative timeout waits forever
+func (mysql) Lock(wait bool) (string, string) {
+    unlock := "SELECT RELEASE_LOCK(?)"
+    if wait {
+        return "SELECT GET_LOCK(?, -1) = 1", unlock
+    }
+    return "SELECT GET_LOCK(?, 0) = 1", unlock
+}
+
+type sqlite struct{}
+
+// Placeholder numbers the parameters so they can be used more than once
+func (sqlite) Placeholder(n int) string {
+    return "?" + strconv.Itoa(n)
+}
+
+func (sqlite) Quote(identifier string) string {
+    return quote(identifier, `"`)
+}
+
+func (sqlite) BlobType() string {
+    return "BLOB"
+}
+
+func (d sqlite) CreateTable(table string, columns []string, indexes ...[]string) []string {
+    return createTable(d, table, columns, indexes)
+}
+
+func (d sqlite) CreateIndex(table string, columns ...string) string {
+    return "CREATE INDEX IF NOT EXISTS " + index(d, table, columns)
+}
+
+// Upsert uses ON CONFLICT rather than INSERT OR REPLACE which deletes the conflicting row first
+func (d sqlite) Upsert(table string, key []string, columns ...string) string {
+    return upsert(d, table, key, columns)
+}
+
+func (d sqlite) Incr(table string) (string, string) {
+    return incrReturning(d, table), ""
+}
+
+func (sqlite) Limit(n int) string {
+    return "LIMIT " + strconv.Itoa(n)
+}
+
+func (sqlite) Columns() string {
+    return "SELECT name, type FROM pragma_table_info(?1)"
+}
+
+// AlterColumn returns no statements, SQLite does not enforce column types and every INTEGER holds 64 bits
+func (sqlite) AlterColumn(table, column, columnType string, notNull bool) []string {
+    return nil
+}
+
+// Lock returns no statements, SQLite has a single writer so transactions writing first serialize on their own
+func (sqlite) Lock(wait bool) (string, string) {
+    return "", ""
+}
+
+// ----------------------- helpers shared by the dialects
+
+func quote(identifier, q string) string {
+    return q + strings.Replace(identifier, q, q+q, -1) + q
+}
+
+func quoteAll(d Dialect, identifiers []string) string {
+    var q []string
+    for _, i := range identifiers {
+        q = append(q, d.Quote(i))
+    }
+    return strings.Join(q, ", ")
+}
+
+func indexName(table string, columns []string) string {
+    return table + "_" + strings.Join(columns, "_") + "_idx"
+}
+
+func createTable(d Dialect, table string, columns []string, indexes [][]string) []string {
+    queries := []string{fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", d.Quote(table), strings.Join(columns, ", "))}
+    for _, index := range indexes {
+        queries = append(queries, d.CreateIndex(table, index...))
+    }
+    return queries
+}
+
+func index(d Dialect, table string, columns []string) string {
+    return fmt.Sprintf("%s ON %s (%s)", d.Quote(indexName(table, columns)), d.Quote(table), quoteAll(d, columns))
+}
+
+// incrReturning uses the INSERT ... ON CONFLICT ... RETURNING syntax shared by Postgres and SQLite
+func incrReturning(d Dialect, table string) string {
+    t := d.Quote(table)
+    return fmt.Sprintf("INSERT INTO %s (id, data, counter, expired_at) VALUES (%s, %s, 1, %s) "+
+        "ON CONFLICT (id) DO UPDATE SET "+
+        "counter = CASE WHEN %s.expired_at > %s THEN COALESCE(%s.counter, 0) + 1 ELSE 1 END, "+
+        "expired_at = CASE WHEN %s.expired_at > %s THEN %s.expired_at ELSE EXCLUDED.expired_at END "+
+        "RETURNING counter",
+        t, d.Placeholder(1), d.Placeholder(2), d.Placeholder(3),
+        t, d.Placeholder(4), t,
+        t, d.Placeholder(4), t)
+}
+
+func insert(d Dialect, table string, columns []string) string {
+    var values []string
+    for n := range columns {
+        values = append(values, d.Placeholder(n+1))
+    }
+    return fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", d.Quote(table), quoteAll(d, columns), strings.Join(values, ", "))
+}
+
+// upsert uses the INSERT ... ON CONFLICT syntax shared by Postgres and SQLite
+func upsert(d Dialect, table string, key []string, columns []string) string {
+    var set []string
+    for _, c := range columns {
+        if !inArr(key, c) {
+            set = append(set, fmt.Sprintf("%s = EXCLUDED.%s", d.Quote(c), d.Quote(c)))
+        }
+    }
+    if len(set) == 0 {
+        return fmt.Sprintf("%s ON CONFLICT (%s) DO NOTHING", insert(d, table, columns), quoteAll(d, key))
+    }
+    return fmt.Sprintf("%s ON CONFLICT (%s) DO UPDATE SET %s", insert(d, table, columns), quoteAll(d, key), strings.Join(set, ", "))
+}
@@ -0,0 +1,80 @@
+package cachita
+
+import (
+    "testing"
+
+    "github.com/stretchr/testify/assert"
+)
+
+func TestDialectPlaceholder(t *testing.T) {
+    t.Parallel()
+    assert.Equal(t, "$2", Postgres.Placeholder(2))
+    assert.Equal(t, "?", MySQL.Placeholder(2))
+    assert.Equal(t, "?2", SQLite.Placeholder(2))
+}
+
+func TestDialectQuote(t *testing.T) {
+    t.Parallel()
+    assert.Equal(t, `"keys"`, Postgres.Quote("keys"))
+    assert.Equal(t, "`keys`", MySQL.Quote("keys"))
+    assert.Equal(t, "`a``b`", MySQL.Quote("a`b"))
+    assert.Equal(t, `"a""b"`, SQLite.Quote(`a"b`))
+}
+
+func TestDialectCreateTable(t *testing.T) {
+    t.Parallel()
+    columns := []string{"id CHAR(32) NOT NULL PRIMARY KEY", "expired_at BIGINT NOT NULL"}
+    assert.Equal(t, []string{
+        `CREATE TABLE IF NOT EXISTS "c" (id CHAR(32) NOT NULL PRIMARY KEY, expired_at BIGINT NOT NULL)`,
+        `CREATE INDEX IF NOT EXISTS "c_expired_at_idx" ON "c" ("expired_at")`,
+    }, Postgres.CreateTable("c", columns, []string{"expired_at"}))
+    assert.Equal(t, []string{
+        "CREATE TABLE IF NOT EXISTS `c` (id CHAR(32) NOT NULL PRIMARY KEY, expired_at BIGINT NOT NULL, INDEX `c_expired_at_idx` (`expired_at`))",
+    }, MySQL.CreateTable("c", columns, []string{"expired_at"}))
+}
+
+func TestDialectUpsert(t *testing.T) {
+    t.Parallel()
+    assert.Equal(t,
+        `INSERT INTO "c" ("id", "data") VALUES ($1, $2) ON CONFLICT ("id") DO UPDATE SET "data" = EXCLUDED."data"`,
+        Postgres.Upsert("c", []string{"id"}, "id", "data"))
+    assert.Equal(t,
+        `INSERT INTO "c" ("id", "data") VALUES (?1, ?2) ON CONFLICT ("id") DO UPDATE SET "data" = EXCLUDED."data"`,
+        SQLite.Upsert("c", []string{"id"}, "id", "data"))
+    assert.Equal(t,
+        "INSERT INTO `c` (`id`, `data`) VALUES (?, ?) ON DUPLICATE KEY UPDATE `data` = VALUES(`data`)",
+        MySQL.Upsert("c", []string{"id"}, "id", "data"))
+}
+
+func TestDialectInsertIgnore(t *testing.T) {
+    t.Parallel()
+    assert.Equal(t,
+        `INSERT INTO "t" ("a", "b") VALUES ($1, $2) ON CONFLICT ("a", "b") DO NOTHING`,
+        Postgres.Upsert("t", []string{"a", "b"}, "a", "b"))
+    assert.Equal(t,
+        "INSERT INTO `t` (`a`, `b`) VALUES (?, ?) ON DUPLICATE KEY UPDATE `a` = `a`",
+        MySQL.Upsert("t", []string{"a", "b"}, "a", "b"))
+}
+
+func TestDialectFromDriver(t *testing.T) {
+    t.Parallel()
+    assert.Equal(t, Postgres, dialect("postgres", ""))
+    assert.Equal(t, Postgres, dialect("pgx", ""))
+    assert.Equal(t, SQLite, dialect("sqlite", ""))
+    assert.Equal(t, MySQL, dialect("mysql", ""))
+}
+
+func TestDialectAlterColumn(t *testing.T) {
+    t.Parallel()
+    assert.Equal(t, []string{`ALTER TABLE "c" ALTER COLUMN "expired_at" TYPE BIGINT, ALTER COLUMN "expired_at" SET NOT NULL`},
+        Postgres.AlterColumn("c", "expired_at", "BIGINT", true))
+    assert.Equal(t, []string{"ALTER TABLE `c` MODIFY `expired_at` BIGINT NOT NULL"}, MySQL.AlterColumn("c", "expired_at", "BIGINT", true))
+    assert.Empty(t, SQLite.AlterColumn("c", "expired_at", "BIGINT", true))
+}
+
+func TestDialectCreateIndex(t *testing.T) {
+    t.Parallel()
+    assert.Equal(t, `CREATE INDEX IF NOT EXISTS "c_expired_at_idx" ON "c" ("expired_at")`, Postgres.CreateIndex("c", "expired_at"))
+    assert.Equal(t, "CREATE INDEX `c_a_b_idx` ON `c` (`a`, `b`)", MySQL.CreateIndex("c", "a", "b"))
+    assert.Equal(t, `CREATE INDEX IF NOT EXISTS "c_expired_at_idx" ON "c" ("expired_at")`, SQLite.CreateIndex("c", "expired_at"))
+}
@@ -95,7 +95,7 @@ func ExampleNewMemoryCache() {
 
 }
 
-func ExampleTaggedCache() {
+func ExampleCache_tag() {
     cache := cachita.NewMemoryCache(1*time.Millisecond, 1*time.Minute) // default ttl 1 millisecond
 
     err := cache.Put("cache_key", "some data", 0) // ttl = 0 means use default
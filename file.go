@@ -1,11 +1,13 @@
 package cachita
 
 import (
+    "encoding/hex"
     "fmt"
     "io"
     "io/ioutil"
     "os"
     "path/filepath"
+    "sort"
     "sync"
     "time"
 
@@ -14,20 +16,34 @@ import (
 
 const FileIndex = "github.com/gadelkareem/cachita/file-index"
 
+// fileNamespaces is the directory of the namespaces of a file cache, each in a directory named after its id
+const fileNamespaces = "namespaces"
+
 var fCache Cache
 
 type file struct {
-    dir string
-    ttl time.Duration
-    i   *fileIndex
+    dir      string
+    ttl      time.Duration
+    i        *fileIndex
+    codec    *codec
+    depth    int
+    width    int
+    metadata bool
+    onError  func(err error)
+    // namespaces are file caches in the namespaces directory
+    namespacesMu sync.Mutex
+    namespaces   map[string]*file
 }
 
 type fileIndex struct {
     recordsMu sync.RWMutex
     records   map[string]time.Time
-    tagsMu    sync.Mutex
-    tags      map[string][]string
-    path      string
+    // order lists the ids of records in the order they were added so that Keys walks it by batches,
+    // removed records are kept with a zero expiry until expiredRecords compacts both
+    order  []string
+    tagsMu sync.Mutex
+    tags   map[string][]string
+    path   string
 }
 
 func File() (Cache, error) {
@@ -45,20 +61,30 @@ func File() (Cache, error) {
     return fCache, nil
 }
 
-func NewFileCache(dir string, ttl, tickerTtl time.Duration) (Cache, error) {
+func NewFileCache(dir string, ttl, tickerTtl time.Duration, opts ...Option) (Cache, error) {
     var (
         err error
         i   *fileIndex
+        o   *options
     )
+    o, err = newOptions(opts)
+    if err != nil {
+        return nil, err
+    }
     i, err = newIndex(dir, ttl)
     if err != nil {
         return nil, err
     }
 
     c := &file{
-        dir: dir,
-        ttl: ttl,
-        i:   i,
+        dir:      dir,
+        ttl:      ttl,
+        i:        i,
+        codec:    o.codec,
+        depth:    o.fileDepth,
+        width:    o.fileWidth,
+        metadata: o.metadata,
+        onError:  o.onError,
     }
     if tickerTtl != 0 {
         runEvery(tickerTtl, func() {
@@ -68,6 +94,19 @@ func NewFileCache(dir string, ttl, tickerTtl time.Duration) (Cache, error) {
     return c, nil
 }
 
+// WithFanOut sets the number of directory levels used by the file cache and the number of id characters
+// naming each level, the default is 2 levels of 1 character
+func WithFanOut(depth, width int) Option {
+    return func(o *options) {
+        if depth < 0 || width < 1 || depth*width > 32 {
+            o.err = fmt.Errorf("cachita: invalid fan-out of %d levels of %d characters", depth, width)
+            return
+        }
+        o.fileDepth = depth
+        o.fileWidth = width
+    }
+}
+
 func (c *file) Exists(key string) bool {
     err := c.i.check(Id(key))
     return err == nil
@@ -78,13 +117,52 @@ func (c *file) Get(key string, i interface{}) error {
     if err := c.i.check(id); err != nil {
         return err
     }
-    return readData(c.path(id), i)
+    path := c.path(id)
+    err := c.read(path, i)
+    if err == ErrCorrupt && c.codec.invalidateCorrupt {
+        _ = c.Invalidate(key)
+    }
+    if err == nil && c.metadata {
+        // the access time is set explicitly since file systems are often mounted noatime or relatime
+        if info, err := os.Stat(path); err == nil {
+            _ = os.Chtimes(path, time.Now(), info.ModTime())
+        }
+    }
+    return err
+}
+
+// Stat returns the metadata of the file of key, its creation time is the modification time of the file
+func (c *file) Stat(key string) (Metadata, error) {
+    id := Id(key)
+    path := c.path(id)
+    info, err := os.Stat(path)
+    if err != nil {
+        if isNotFound(err) {
+            return Metadata{}, ErrNotFound
+        }
+        return Metadata{}, err
+    }
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        return Metadata{}, err
+    }
+    m := Metadata{
+        Key:       key,
+        CreatedAt: info.ModTime(),
+        ExpiredAt: expiry(c.i.expiredAt(id)),
+        Size:      info.Size(),
+        Codec:     codecName(data),
+    }
+    if atime := accessTime(info); atime.After(m.CreatedAt) {
+        m.AccessedAt = atime
+    }
+    return m, nil
 }
 
 func (c *file) Put(key string, i interface{}, ttl time.Duration) error {
     id := Id(key)
     c.i.add(id, expiredAt(ttl, c.ttl))
-    return writeData(c.path(id), i)
+    return c.write(c.path(id), key, i)
 }
 
 func (c *file) Incr(key string, ttl time.Duration) (int64, error) {
@@ -92,12 +170,12 @@ func (c *file) Incr(key string, ttl time.Duration) (int64, error) {
     c.i.checkOrAdd(id, expiredAt(ttl, c.ttl))
     var n int64
     path := c.path(id)
-    err := readData(path, &n)
+    err := c.read(path, &n)
     if err != nil && !IsErrorOk(err) {
         return 0, err
     }
     n++
-    return n, writeData(path, &n)
+    return n, c.write(path, key, &n)
 }
 
 func (c *file) Invalidate(key string) error {
@@ -111,32 +189,189 @@ func (c *file) Invalidate(key string) error {
 }
 
 func (c *file) path(id string) string {
-    return filepath.Join(c.dir, string(id[0]), string(id[1]), id)
+    return filePath(c.dir, id, c.depth, c.width)
+}
+
+// filePath nests the file in depth directories named after the next width characters of the id
+func filePath(dir, id string, depth, width int) string {
+    parts := []string{dir}
+    for l := 0; l < depth; l++ {
+        parts = append(parts, id[l*width:(l+1)*width])
+    }
+    return filepath.Join(append(parts, id)...)
+}
+
+func (c *file) read(path string, i interface{}) error {
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        if isNotFound(err) {
+            return ErrNotFound
+        }
+        return err
+    }
+    if len(data) == 0 {
+        return ErrNotFound
+    }
+    return c.codec.unmarshal(data, i)
+}
+
+// write stores the original key with the data so the cache files can be inspected
+func (c *file) write(path, key string, i interface{}) error {
+    data, err := c.codec.marshal(key, i)
+    if err != nil {
+        return err
+    }
+    err = ioutil.WriteFile(path, data, 0666)
+    if os.IsNotExist(err) {
+        // directories are only created once they are needed
+        err = os.MkdirAll(filepath.Dir(path), os.ModePerm)
+        if err != nil {
+            return err
+        }
+        err = ioutil.WriteFile(path, data, 0666)
+    }
+    return err
 }
 
 func (c *file) deleteExpired() {
-    expired := c.i.expiredRecords()
+    expired, err := c.i.expiredRecords()
+    if err != nil {
+        c.onError(fmt.Errorf("writing the index of %s: %v", c.dir, err))
+    }
     for _, id := range expired {
         _ = os.Remove(c.path(id))
     }
+
+    for _, n := range c.children() {
+        n.deleteExpired()
+    }
+}
+
+// Flush removes the files of the cache and of its namespaces, and empties the index
+func (c *file) Flush() error {
+    // the namespaces in use keep their directory and index
+    namespaces := make(map[string]bool)
+    for _, n := range c.children() {
+        if err := n.Flush(); err != nil {
+            return err
+        }
+        namespaces[filepath.Base(n.dir)] = true
+    }
+    err := removeAll(filepath.Join(c.dir, fileNamespaces), namespaces)
+    if err != nil {
+        return err
+    }
+    err = removeAll(c.dir, map[string]bool{Id(FileIndex): true, fileNamespaces: true})
+    if err != nil {
+        return err
+    }
+    return c.i.reset()
+}
+
+// removeAll removes the entries of dir but the kept ones
+func removeAll(dir string, keep map[string]bool) error {
+    entries, err := ioutil.ReadDir(dir)
+    if err != nil && !os.IsNotExist(err) {
+        return err
+    }
+    for _, e := range entries {
+        if keep[e.Name()] {
+            continue
+        }
+        if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// namespace returns the cache of the namespace, its expired files are deleted with the ones of c
+func (c *file) namespace(name string) (Cache, error) {
+    c.namespacesMu.Lock()
+    defer c.namespacesMu.Unlock()
+    if n, exists := c.namespaces[name]; exists {
+        return n, nil
+    }
+    dir := filepath.Join(c.dir, fileNamespaces, Id(name))
+    i, err := newIndex(dir, c.ttl)
+    if err != nil {
+        return nil, err
+    }
+    if c.namespaces == nil {
+        c.namespaces = make(map[string]*file)
+    }
+    n := &file{
+        dir:      dir,
+        ttl:      c.ttl,
+        i:        i,
+        codec:    c.codec,
+        depth:    c.depth,
+        width:    c.width,
+        metadata: c.metadata,
+        onError:  c.onError,
+    }
+    c.namespaces[name] = n
+    return n, nil
+}
+
+func (c *file) children() []*file {
+    c.namespacesMu.Lock()
+    defer c.namespacesMu.Unlock()
+    var children []*file
+    for _, n := range c.namespaces {
+        children = append(children, n)
+    }
+    return children
 }
 
 func (c *file) InvalidateMulti(keys ...string) (err error) {
     var ids []string
     for _, key := range keys {
         id := Id(key)
+        ids = append(ids, id)
         err = os.Remove(c.path(id))
         if err != nil && !isNotFound(err) {
             return
         }
     }
     c.i.removeMulti(ids...)
-    return
+    return nil
+}
+
+// Keys reads the keys stored in the files of the ids of the index, the files written by older versions
+// without their key are skipped
+func (c *file) Keys(pattern string) KeyIterator {
+    var ids []string
+    started := false
+    return &keyIterator{fetch: func() ([]string, bool, error) {
+        if !started {
+            ids, started = c.i.ids(), true
+        }
+        var keys []string
+        n := keysBatch
+        if n > len(ids) {
+            n = len(ids)
+        }
+        for _, id := range c.i.live(ids[:n]) {
+            key, err := fileKey(c.path(id), c.codec)
+            if err != nil && !isNotFound(err) && err != ErrCorrupt {
+                return nil, false, err
+            }
+            if key != "" && matchKey(pattern, key) {
+                keys = append(keys, key)
+            }
+        }
+        ids = ids[n:]
+        return keys, len(ids) == 0, nil
+    }}
+}
+
+func (c *file) InvalidatePattern(pattern string) error {
+    return invalidatePattern(c, pattern)
 }
 
 // tags are only managed via the index
 func (c *file) Tag(key string, tags ...string) error {
-    tags = uniqueTags(tags)
     c.i.tag(Id(key), tags...)
     return nil
 }
@@ -154,6 +389,37 @@ func (c *file) InvalidateTags(tags ...string) (err error) {
     return nil
 }
 
+// KeysByTags reads the keys stored in the files of the matching ids that did not expire
+func (c *file) KeysByTags(all, any []string) ([]string, error) {
+    var keys []string
+    for _, id := range c.i.matchTags(all, any) {
+        if c.i.check(id) != nil {
+            continue
+        }
+        key, err := fileKey(c.path(id), c.codec)
+        if err != nil && !isNotFound(err) && err != ErrCorrupt {
+            return nil, err
+        }
+        if key != "" {
+            keys = append(keys, key)
+        }
+    }
+    sort.Strings(keys)
+    return keys, nil
+}
+
+func (c *file) InvalidateTagsAll(tags ...string) (err error) {
+    ids := c.i.removeTagsAll(tags...)
+    for _, id := range ids {
+        err = os.Remove(c.path(id))
+        if err != nil && !isNotFound(err) {
+            return
+        }
+    }
+    c.i.removeMulti(ids...)
+    return nil
+}
+
 // ----------------------- fileIndex
 
 func newIndex(dir string, ttl time.Duration) (i *fileIndex, err error) {
@@ -166,40 +432,31 @@ func newIndex(dir string, ttl time.Duration) (i *fileIndex, err error) {
         return
     }
 
-    var (
-        currentDir string
-        files      []os.FileInfo
-    )
+    err = os.MkdirAll(dir, os.ModePerm)
+    if err != nil {
+        return
+    }
+
     i.recordsMu.Lock()
     defer i.recordsMu.Unlock()
-    characters := "0123456789abcdef"
-    for _, char1 := range characters {
-        for _, char2 := range characters {
-            currentDir = filepath.Join(dir, string(char1), string(char2))
-            if ok, _ := exists(currentDir); !ok {
-                err = os.MkdirAll(currentDir, os.ModePerm)
-                if err != nil {
-                    return
-                }
-            }
-            files, err = ioutil.ReadDir(currentDir)
-            if err != nil {
-                return
-            }
-
-            for _, f := range files {
-                if f.IsDir() {
-                    continue
-                }
-                if _, exists := i.records[f.Name()]; exists {
-                    continue
-                }
-                expiredAt := f.ModTime().Add(ttl)
-                if expiredAt.After(time.Now()) {
-                    i.records[f.Name()] = expiredAt
-                }
-            }
+    err = walkFiles(dir, func(path string, f os.FileInfo) error {
+        if _, exists := i.records[f.Name()]; exists {
+            return nil
+        }
+        expiredAt := never
+        if ttl != Forever {
+            expiredAt = f.ModTime().Add(ttl)
         }
+        if expiredAt.After(time.Now()) {
+            i.records[f.Name()] = expiredAt
+        }
+        return nil
+    })
+    if err != nil {
+        return
+    }
+    for id := range i.records {
+        i.order = append(i.order, id)
     }
     err = writeData(i.path, &i.records)
     if err != nil {
@@ -212,7 +469,7 @@ func (i *fileIndex) check(id string) error {
     i.recordsMu.RLock()
     defer i.recordsMu.RUnlock()
     expiredAt, exists := i.records[id]
-    if !exists {
+    if !exists || expiredAt.IsZero() {
         return ErrNotFound
     }
     if expiredAt.Before(time.Now()) {
@@ -221,58 +478,111 @@ func (i *fileIndex) check(id string) error {
     return nil
 }
 
-func (i *fileIndex) expiredRecords() []string {
+// ids returns the order of the ids, it is only appended to while the index is in use
+func (i *fileIndex) ids() []string {
+    i.recordsMu.RLock()
+    defer i.recordsMu.RUnlock()
+    return i.order
+}
+
+// live returns the ids of the records that did not expire
+func (i *fileIndex) live(ids []string) []string {
+    i.recordsMu.RLock()
+    defer i.recordsMu.RUnlock()
+    now := time.Now()
+    var live []string
+    for _, id := range ids {
+        if i.records[id].After(now) {
+            live = append(live, id)
+        }
+    }
+    return live
+}
+
+func (i *fileIndex) expiredAt(id string) time.Time {
+    i.recordsMu.RLock()
+    defer i.recordsMu.RUnlock()
+    return i.records[id]
+}
+
+// expiredRecords removes the expired records from the index and writes it
+func (i *fileIndex) expiredRecords() ([]string, error) {
     i.recordsMu.Lock()
     defer i.recordsMu.Unlock()
     var (
         expired []string
         records = make(map[string]time.Time)
+        // order is replaced rather than compacted in place since the iterators of Keys read it
+        order = make([]string, 0, len(i.order))
+        now   = time.Now()
     )
-    for id, expiredAt := range i.records {
-        if expiredAt.Before(time.Now()) {
+    for _, id := range i.order {
+        expiredAt := i.records[id]
+        if expiredAt.IsZero() {
+            continue
+        }
+        if expiredAt.Before(now) {
             expired = append(expired, id)
             continue
         }
         records[id] = expiredAt
+        order = append(order, id)
     }
-    i.records = records
-    err := writeData(i.path, &i.records)
-    if err != nil {
-        fmt.Printf("cachita: error writing index file: %v", err)
+    i.records, i.order = records, order
+    return expired, writeData(i.path, &i.records)
+}
+
+// set adds the id to order when it is not in records, recordsMu must be locked
+func (i *fileIndex) set(id string, expiredAt time.Time) {
+    if _, exists := i.records[id]; !exists {
+        i.order = append(i.order, id)
     }
-    return expired
+    i.records[id] = expiredAt
 }
 
 func (i *fileIndex) add(id string, expiredAt time.Time) {
     i.recordsMu.Lock()
     defer i.recordsMu.Unlock()
-    i.records[id] = expiredAt
-    return
+    i.set(id, expiredAt)
 }
 
 func (i *fileIndex) checkOrAdd(id string, expiredAt time.Time) {
     i.recordsMu.Lock()
     defer i.recordsMu.Unlock()
-    exp, k := i.records[id]
-    if !k || exp.Before(time.Now()) {
-        i.records[id] = expiredAt
+    if i.records[id].Before(time.Now()) {
+        i.set(id, expiredAt)
     }
 }
 
 func (i *fileIndex) remove(id string) {
     i.recordsMu.Lock()
     defer i.recordsMu.Unlock()
-    delete(i.records, id)
+    if _, exists := i.records[id]; exists {
+        i.records[id] = time.Time{}
+    }
 }
 
 func (i *fileIndex) removeMulti(ids ...string) {
     i.recordsMu.Lock()
     defer i.recordsMu.Unlock()
     for _, id := range ids {
-        delete(i.records, id)
+        if _, exists := i.records[id]; exists {
+            i.records[id] = time.Time{}
+        }
     }
 }
 
+// reset empties the index
+func (i *fileIndex) reset() error {
+    i.tagsMu.Lock()
+    i.tags = make(map[string][]string)
+    i.tagsMu.Unlock()
+    i.recordsMu.Lock()
+    defer i.recordsMu.Unlock()
+    i.records, i.order = make(map[string]time.Time), nil
+    return writeData(i.path, &i.records)
+}
+
 func (i *fileIndex) tag(id string, tags ...string) {
     tags = uniqueTags(tags)
     i.tagsMu.Lock()
@@ -296,17 +606,120 @@ func (i *fileIndex) removeTags(tags ...string) (ids []string) {
     return
 }
 
+// matchTags returns the ids tagged with every tag of all and one of any
+func (i *fileIndex) matchTags(all, any []string) []string {
+    i.tagsMu.Lock()
+    defer i.tagsMu.Unlock()
+    return matchTags(all, any, func(tag string) []string {
+        return i.tags[tag]
+    })
+}
+
+// removeTagsAll removes the ids tagged with every tag from the tags and returns them
+func (i *fileIndex) removeTagsAll(tags ...string) []string {
+    tags = uniqueTags(tags)
+    i.tagsMu.Lock()
+    defer i.tagsMu.Unlock()
+    ids := matchTags(tags, nil, func(tag string) []string {
+        return i.tags[tag]
+    })
+    for _, t := range tags {
+        var kept []string
+        for _, id := range i.tags[t] {
+            if !inArr(ids, id) {
+                kept = append(kept, id)
+            }
+        }
+        if len(kept) == 0 {
+            delete(i.tags, t)
+        } else {
+            i.tags[t] = kept
+        }
+    }
+    return ids
+}
+
 // --------------------
 
-func exists(path string) (bool, error) {
-    _, err := os.Stat(path)
-    if err == nil {
-        return true, nil
+// MigrateFileCache moves the files of an existing file cache directory to the layout set by opts,
+// it should not be used while the cache is open
+func MigrateFileCache(dir string, opts ...Option) error {
+    o, err := newOptions(opts)
+    if err != nil {
+        return err
     }
-    if isNotFound(err) {
-        return false, nil
+    var dirs []string
+    err = filepath.Walk(dir, func(path string, f os.FileInfo, err error) error {
+        if err != nil {
+            return err
+        }
+        if f.IsDir() {
+            // namespaces are migrated once the files of the cache are
+            if f.Name() == fileNamespaces && filepath.Dir(path) == filepath.Clean(dir) {
+                return filepath.SkipDir
+            }
+            if path != dir {
+                dirs = append(dirs, path)
+            }
+            return nil
+        }
+        if !isId(f.Name()) || f.Name() == Id(FileIndex) {
+            return nil
+        }
+        newPath := filePath(dir, f.Name(), o.fileDepth, o.fileWidth)
+        if newPath == path {
+            return nil
+        }
+        err = os.MkdirAll(filepath.Dir(newPath), os.ModePerm)
+        if err != nil {
+            return err
+        }
+        return os.Rename(path, newPath)
+    })
+    if err != nil {
+        return err
+    }
+    // remove the directories left empty, deepest first
+    for n := len(dirs) - 1; n >= 0; n-- {
+        _ = os.Remove(dirs[n])
+    }
+
+    namespaces, err := ioutil.ReadDir(filepath.Join(dir, fileNamespaces))
+    if err != nil && !os.IsNotExist(err) {
+        return err
     }
-    return false, err
+    for _, n := range namespaces {
+        if err := MigrateFileCache(filepath.Join(dir, fileNamespaces, n.Name()), opts...); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// walkFiles calls f for every cache file in dir whatever the directory layout is
+func walkFiles(dir string, f func(path string, info os.FileInfo) error) error {
+    index := Id(FileIndex)
+    return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+        if err != nil {
+            return err
+        }
+        // namespaces are caches of their own
+        if info.IsDir() && info.Name() == fileNamespaces && filepath.Dir(path) == filepath.Clean(dir) {
+            return filepath.SkipDir
+        }
+        if info.IsDir() || !isId(info.Name()) || info.Name() == index {
+            return nil
+        }
+        return f(path, info)
+    })
+}
+
+func isId(name string) bool {
+    if len(name) != 32 {
+        return false
+    }
+    _, err := hex.DecodeString(name)
+    return err == nil
 }
 
 func readData(path string, i interface{}) error {
@@ -0,0 +1,161 @@
+package cachita
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "time"
+)
+
+// FileEntry describes a file of a file cache directory
+type FileEntry struct {
+    Id        string
+    Key       string // empty for files written by older versions, or encrypted without the options of the cache
+    Path      string
+    Size      int64
+    ModTime   time.Time
+    ExpiredAt time.Time // zero when the file is missing from the index
+}
+
+func (e FileEntry) Indexed() bool {
+    return !e.ExpiredAt.IsZero()
+}
+
+func (e FileEntry) Expired() bool {
+    return e.Indexed() && e.ExpiredAt.Before(time.Now())
+}
+
+// Decode reads the value of the entry into i, the cache options are needed to read encrypted entries
+func (e FileEntry) Decode(i interface{}, opts ...Option) error {
+    o, err := newOptions(opts)
+    if err != nil {
+        return err
+    }
+    data, err := ioutil.ReadFile(e.Path)
+    if err != nil {
+        return err
+    }
+    return o.codec.unmarshal(data, i)
+}
+
+// ScanFileCache calls f for every entry of the file cache in dir, the options of the cache are needed to
+// read the keys of encrypted entries
+func ScanFileCache(dir string, f func(e FileEntry) error, opts ...Option) error {
+    o, err := newOptions(opts)
+    if err != nil {
+        return err
+    }
+    records, err := readIndex(dir)
+    if err != nil {
+        return err
+    }
+    return walkFiles(dir, func(path string, info os.FileInfo) error {
+        e := FileEntry{
+            Id:        info.Name(),
+            Path:      path,
+            Size:      info.Size(),
+            ModTime:   info.ModTime(),
+            ExpiredAt: records[info.Name()],
+        }
+        key, err := fileKey(path, o.codec)
+        if err != nil && err != ErrCorrupt {
+            return err
+        }
+        e.Key = key
+        return f(e)
+    })
+}
+
+// VerifyFileIndex returns the ids in the index of dir without a file and the ids of the files missing from the index
+func VerifyFileIndex(dir string) (missing, unindexed []string, err error) {
+    records, err := readIndex(dir)
+    if err != nil {
+        return
+    }
+    files := make(map[string]struct{})
+    err = walkFiles(dir, func(path string, info os.FileInfo) error {
+        files[info.Name()] = struct{}{}
+        if _, exists := records[info.Name()]; !exists {
+            unindexed = append(unindexed, info.Name())
+        }
+        return nil
+    })
+    if err != nil {
+        return
+    }
+    for id := range records {
+        if _, exists := files[id]; !exists {
+            missing = append(missing, id)
+        }
+    }
+    return
+}
+
+// RebuildFileIndex rewrites the index of dir from its files, files missing from the index
+// expire ttl after their last modification
+func RebuildFileIndex(dir string, ttl time.Duration) error {
+    records, err := readIndex(dir)
+    if err != nil {
+        return err
+    }
+    rebuilt := make(map[string]time.Time)
+    err = walkFiles(dir, func(path string, info os.FileInfo) error {
+        expiredAt, exists := records[info.Name()]
+        if !exists {
+            expiredAt = info.ModTime().Add(ttl)
+        }
+        rebuilt[info.Name()] = expiredAt
+        return nil
+    })
+    if err != nil {
+        return err
+    }
+    return writeData(filepath.Join(dir, Id(FileIndex)), &rebuilt)
+}
+
+// PurgeFileCache removes the expired entries of dir and returns how many were removed
+func PurgeFileCache(dir string) (n int, err error) {
+    records, err := readIndex(dir)
+    if err != nil {
+        return
+    }
+    err = walkFiles(dir, func(path string, info os.FileInfo) error {
+        expiredAt, exists := records[info.Name()]
+        if !exists || expiredAt.After(time.Now()) {
+            return nil
+        }
+        if err := os.Remove(path); err != nil && !isNotFound(err) {
+            return err
+        }
+        n++
+        return nil
+    })
+    if err != nil {
+        return
+    }
+    for id, expiredAt := range records {
+        if expiredAt.Before(time.Now()) {
+            delete(records, id)
+        }
+    }
+    err = writeData(filepath.Join(dir, Id(FileIndex)), &records)
+    return
+}
+
+func readIndex(dir string) (map[string]time.Time, error) {
+    records := make(map[string]time.Time)
+    err := readData(filepath.Join(dir, Id(FileIndex)), &records)
+    if err != nil && err != ErrNotFound {
+        return nil, err
+    }
+    return records, nil
+}
+
+// fileKey reads the key stored in the file at path
+func fileKey(path string, c *codec) (string, error) {
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        return "", err
+    }
+    return c.key(data)
+}
@@ -0,0 +1,114 @@
+package cachita
+
+import (
+    "bytes"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+
+    "github.com/stretchr/testify/assert"
+)
+
+func TestScanFileCache(t *testing.T) {
+    t.Parallel()
+    path, c := maintenanceCache(t, "tmp11/file-cache")
+    isError(c.Put("user:1", "(◕‿◕)", time.Hour), t)
+    isError(c.Put("user:2", map[string]interface{}{"a": "b"}, time.Millisecond), t)
+    flushIndex(c, t)
+    time.Sleep(5 * time.Millisecond)
+
+    entries := make(map[string]FileEntry)
+    isError(ScanFileCache(path, func(e FileEntry) error {
+        entries[e.Key] = e
+        return nil
+    }), t)
+    assert.Len(t, entries, 2)
+    assert.Equal(t, Id("user:1"), entries["user:1"].Id)
+    assert.False(t, entries["user:1"].Expired())
+    assert.True(t, entries["user:2"].Expired())
+    assert.True(t, entries["user:1"].Size > 0)
+
+    var d string
+    isError(entries["user:1"].Decode(&d), t)
+    assert.Equal(t, "(◕‿◕)", d)
+}
+
+func TestScanFileCache_Encrypted(t *testing.T) {
+    t.Parallel()
+    encryption := WithEncryption(EncryptionKey{Id: 1, Key: bytes.Repeat([]byte{1}, 16)})
+    path, c := maintenanceCache(t, "tmp20/file-cache", encryption)
+    isError(c.Put("user:jane@x.com", "(◕‿◕)", time.Hour), t)
+    flushIndex(c, t)
+    data, err := ioutil.ReadFile(c.(*file).path(Id("user:jane@x.com")))
+    isError(err, t)
+    assert.False(t, bytes.Contains(data, []byte("jane@x.com")), "the key should be encrypted")
+
+    keys := func(opts ...Option) (keys []string) {
+        isError(ScanFileCache(path, func(e FileEntry) error {
+            keys = append(keys, e.Key)
+            return nil
+        }, opts...), t)
+        return
+    }
+    assert.Equal(t, []string{""}, keys())
+    assert.Equal(t, []string{"user:jane@x.com"}, keys(encryption))
+
+    it := c.(KeyScanner).Keys("user:*")
+    assert.True(t, it.Next())
+    assert.Equal(t, "user:jane@x.com", it.Key())
+}
+
+func TestPurgeFileCache(t *testing.T) {
+    t.Parallel()
+    path, c := maintenanceCache(t, "tmp12/file-cache")
+    isError(c.Put("purge:1", "(◕‿◕)", time.Hour), t)
+    isError(c.Put("purge:2", "(◕‿◕)", time.Millisecond), t)
+    flushIndex(c, t)
+    time.Sleep(5 * time.Millisecond)
+
+    n, err := PurgeFileCache(path)
+    isError(err, t)
+    assert.Equal(t, 1, n)
+    assert.FileExists(t, c.(*file).path(Id("purge:1")))
+    _, err = os.Stat(c.(*file).path(Id("purge:2")))
+    assert.True(t, os.IsNotExist(err))
+}
+
+func TestVerifyAndRebuildFileIndex(t *testing.T) {
+    t.Parallel()
+    path, c := maintenanceCache(t, "tmp13/file-cache")
+    isError(c.Put("verify:1", "(◕‿◕)", time.Hour), t)
+    c.(*file).i.add(Id("verify:missing"), time.Now().Add(time.Hour))
+    flushIndex(c, t)
+    isError(c.Put("verify:2", "(◕‿◕)", time.Hour), t)
+
+    missing, unindexed, err := VerifyFileIndex(path)
+    isError(err, t)
+    assert.Equal(t, []string{Id("verify:missing")}, missing)
+    assert.Equal(t, []string{Id("verify:2")}, unindexed)
+
+    isError(RebuildFileIndex(path, time.Hour), t)
+    missing, unindexed, err = VerifyFileIndex(path)
+    isError(err, t)
+    assert.Empty(t, missing)
+    assert.Empty(t, unindexed)
+}
+
+func maintenanceCache(t *testing.T, dir string, opts ...Option) (string, Cache) {
+    path, err := filepath.Abs(filepath.Dir(os.Args[0]))
+    isError(err, t)
+    path = filepath.Join(path, dir)
+    isError(os.RemoveAll(path), t)
+    c, err := NewFileCache(path, time.Hour, 0, opts...)
+    isError(err, t)
+    return path, c
+}
+
+func flushIndex(c Cache, t *testing.T) {
+    i := c.(*file).i
+    i.recordsMu.RLock()
+    defer i.recordsMu.RUnlock()
+    isError(writeData(i.path, &i.records), t)
+}
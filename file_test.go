@@ -1,6 +1,7 @@
 package cachita
 
 import (
+    "io/ioutil"
     "os"
     "path/filepath"
     "testing"
@@ -24,6 +25,19 @@ func TestFileCacheExpires(t *testing.T) {
     cacheExpires(c, t, 50*time.Millisecond, 150*time.Millisecond)
 }
 
+func TestFileCacheForever(t *testing.T) {
+    t.Parallel()
+    path, err := filepath.Abs(filepath.Dir(os.Args[0]))
+    isError(err, t)
+    path = filepath.Join(path, "tmp15/file-cache")
+    isError(os.RemoveAll(path), t)
+    c, err := NewFileCache(path, Forever, 0)
+    isError(err, t)
+    cacheForever(c, t)
+    isError(c.Put("default", "∞", 0), t)
+    assert.Equal(t, never, c.(*file).i.expiredAt(Id("default")))
+}
+
 func TestFileCacheWithInt(t *testing.T) {
     t.Parallel()
     cacheWithInt(fc(t), t)
@@ -109,3 +123,128 @@ func TestFile_Tag(t *testing.T) {
 func BenchmarkFile_Tag(b *testing.B) {
     benchmarkCacheTag(fc(b), b)
 }
+
+func TestFileCacheWithCompression(t *testing.T) {
+    t.Parallel()
+    path, err := filepath.Abs(filepath.Dir(os.Args[0]))
+    isError(err, t)
+    path = filepath.Join(path, "tmp6/file-cache")
+    c, err := NewFileCache(path, time.Hour, 0, WithCompression(Gzip, 0))
+    isError(err, t)
+    cacheWithStruct(c, t)
+    cacheWithMapInterface(c, t)
+    cacheIncr(c, t)
+}
+
+func TestFileCacheWithEncryption(t *testing.T) {
+    t.Parallel()
+    path, err := filepath.Abs(filepath.Dir(os.Args[0]))
+    isError(err, t)
+    path = filepath.Join(path, "tmp7/file-cache")
+    key := EncryptionKey{Id: 1, Key: []byte("0123456789abcdef0123456789abcdef")}
+    c, err := NewFileCache(path, time.Hour, 0, WithEncryption(key))
+    isError(err, t)
+    cacheWithStruct(c, t)
+    cacheIncr(c, t)
+}
+
+func TestFileCacheCorrupt(t *testing.T) {
+    t.Parallel()
+    path, err := filepath.Abs(filepath.Dir(os.Args[0]))
+    isError(err, t)
+    path = filepath.Join(path, "tmp8/file-cache")
+    c, err := NewFileCache(path, time.Hour, 0, WithChecksum(), WithInvalidateCorrupt())
+    isError(err, t)
+    k := "corrupt"
+    isError(c.Put(k, "(◕‿◕)", 0), t)
+
+    f := c.(*file).path(Id(k))
+    data, err := ioutil.ReadFile(f)
+    isError(err, t)
+    data[2] ^= 1
+    isError(ioutil.WriteFile(f, data, 0666), t)
+
+    var d string
+    assert.Equal(t, ErrCorrupt, c.Get(k, &d))
+    assert.False(t, c.Exists(k))
+    assert.Equal(t, ErrNotFound, c.Get(k, &d))
+}
+
+func TestFileCacheFanOut(t *testing.T) {
+    t.Parallel()
+    path, err := filepath.Abs(filepath.Dir(os.Args[0]))
+    isError(err, t)
+    path = filepath.Join(path, "tmp9/file-cache")
+    isError(os.RemoveAll(path), t)
+    c, err := NewFileCache(path, time.Hour, 0, WithFanOut(3, 2))
+    isError(err, t)
+    files, err := ioutil.ReadDir(path)
+    isError(err, t)
+    for _, f := range files {
+        assert.False(t, f.IsDir(), "directories should be created lazily")
+    }
+
+    k := "fan-out"
+    isError(c.Put(k, "(◕‿◕)", 0), t)
+    id := Id(k)
+    assert.FileExists(t, filepath.Join(path, id[0:2], id[2:4], id[4:6], id))
+    cacheWithStruct(c, t)
+
+    _, err = NewFileCache(path, time.Hour, 0, WithFanOut(20, 2))
+    assert.Error(t, err)
+}
+
+func TestMigrateFileCache(t *testing.T) {
+    t.Parallel()
+    path, err := filepath.Abs(filepath.Dir(os.Args[0]))
+    isError(err, t)
+    path = filepath.Join(path, "tmp10/file-cache")
+    isError(os.RemoveAll(path), t)
+    c, err := NewFileCache(path, time.Hour, 0)
+    isError(err, t)
+    k := "migrate"
+    isError(c.Put(k, "(◕‿◕)", 0), t)
+
+    isError(MigrateFileCache(path, WithFanOut(1, 3)), t)
+    id := Id(k)
+    assert.FileExists(t, filepath.Join(path, id[0:3], id))
+    _, err = os.Stat(filepath.Join(path, id[0:1]))
+    assert.True(t, os.IsNotExist(err), "old directories should be removed")
+
+    c, err = NewFileCache(path, time.Hour, 0, WithFanOut(1, 3))
+    isError(err, t)
+    var d string
+    isError(c.Get(k, &d), t)
+    assert.Equal(t, "(◕‿◕)", d)
+}
+
+func TestFileCacheStat(t *testing.T) {
+    t.Parallel()
+    path, err := filepath.Abs(filepath.Dir(os.Args[0]))
+    isError(err, t)
+    path = filepath.Join(path, "tmp14/file-cache")
+    isError(os.RemoveAll(path), t)
+    c, err := NewFileCache(path, time.Hour, 0, WithMetadata(), WithCompression(Gzip, 0))
+    isError(err, t)
+    s := c.(Statter)
+
+    _, err = s.Stat("missing")
+    assert.Equal(t, ErrNotFound, err)
+
+    isError(c.Put("user:1", "(◕‿◕)", time.Minute), t)
+    m, err := s.Stat("user:1")
+    isError(err, t)
+    assert.Equal(t, "user:1", m.Key)
+    assert.Equal(t, "msgpack+gzip", m.Codec)
+    assert.True(t, m.Size > 0)
+    assert.WithinDuration(t, time.Now(), m.CreatedAt, time.Minute)
+    assert.WithinDuration(t, time.Now().Add(time.Minute), m.ExpiredAt, time.Second)
+    assert.True(t, m.AccessedAt.IsZero())
+
+    time.Sleep(10 * time.Millisecond)
+    var v string
+    isError(c.Get("user:1", &v), t)
+    m, err = s.Stat("user:1")
+    isError(err, t)
+    assert.True(t, m.AccessedAt.After(m.CreatedAt))
+}
@@ -0,0 +1,149 @@
+package cachita
+
+import (
+    "errors"
+    "strings"
+)
+
+// keysBatch is the number of keys fetched or invalidated at once while scanning
+const keysBatch = 100
+
+var errNoKeys = errors.New("cachita: the cache does not enumerate its keys")
+
+// KeyScanner is implemented by the caches enumerating their keys. Patterns match any sequence of characters
+// with *, any character with ? and the next character literally after \.
+type KeyScanner interface {
+    // Keys iterates over the keys of the entries that did not expire matching pattern, fetching them by
+    // batches so that the cache is not blocked. Keys put while iterating may be skipped.
+    Keys(pattern string) KeyIterator
+    // InvalidatePattern invalidates the keys matching pattern by batches
+    InvalidatePattern(pattern string) error
+}
+
+// KeyIterator iterates over the keys of a cache
+type KeyIterator interface {
+    // Next moves to the next key, it returns false at the end of the keys or on errors
+    Next() bool
+    Key() string
+    // Err returns the error that stopped the iteration
+    Err() error
+}
+
+// keyIterator returns the keys of the batches of fetch until it is done
+type keyIterator struct {
+    fetch func() (keys []string, done bool, err error)
+    keys  []string
+    key   string
+    done  bool
+    err   error
+}
+
+func (it *keyIterator) Next() bool {
+    for len(it.keys) == 0 {
+        if it.done || it.err != nil {
+            return false
+        }
+        it.keys, it.done, it.err = it.fetch()
+    }
+    it.key, it.keys = it.keys[0], it.keys[1:]
+    return true
+}
+
+func (it *keyIterator) Key() string {
+    return it.key
+}
+
+func (it *keyIterator) Err() error {
+    return it.err
+}
+
+// errKeys returns an iterator failing with err
+func errKeys(err error) KeyIterator {
+    return &keyIterator{err: err}
+}
+
+// invalidatePattern invalidates the keys of c matching pattern by batches
+func invalidatePattern(c interface {
+    KeyScanner
+    InvalidateMulti(keys ...string) error
+}, pattern string) error {
+    it := c.Keys(pattern)
+    var keys []string
+    for it.Next() {
+        keys = append(keys, it.Key())
+        if len(keys) == keysBatch {
+            if err := c.InvalidateMulti(keys...); err != nil {
+                return err
+            }
+            keys = keys[:0]
+        }
+    }
+    if err := it.Err(); err != nil {
+        return err
+    }
+    if len(keys) == 0 {
+        return nil
+    }
+    return c.InvalidateMulti(keys...)
+}
+
+// matchKey reports whether key matches pattern
+func matchKey(pattern, key string) bool {
+    p, k := []rune(pattern), []rune(key)
+    // the positions to resume from when the last * matches one more character
+    star, next := -1, 0
+    for i, j := 0, 0; j < len(k) || i < len(p); {
+        if i < len(p) {
+            switch c := p[i]; {
+            case c == '*':
+                star, next = i, j
+                i++
+                continue
+            case c == '?' && j < len(k):
+                i++
+                j++
+                continue
+            case c == '\\' && i+1 < len(p) && j < len(k) && p[i+1] == k[j]:
+                i += 2
+                j++
+                continue
+            case c != '?' && c != '\\' && j < len(k) && c == k[j]:
+                i++
+                j++
+                continue
+            }
+        }
+        if star < 0 || next >= len(k) {
+            return false
+        }
+        next++
+        i, j = star+1, next
+    }
+    return true
+}
+
+// escapeGlob escapes s to match it literally, in the patterns of SCAN too
+func escapeGlob(s string) string {
+    var b strings.Builder
+    for _, r := range s {
+        if strings.ContainsRune(`*?[]\`, r) {
+            b.WriteByte('\\')
+        }
+        b.WriteRune(r)
+    }
+    return b.String()
+}
+
+// redisPattern translates pattern to a pattern of SCAN, where brackets are character classes
+func redisPattern(pattern string) string {
+    var b strings.Builder
+    escaped := false
+    for _, r := range pattern {
+        if !escaped && (r == '[' || r == ']') {
+            b.WriteRune('\\')
+        }
+        escaped = !escaped && r == '\\'
+        b.WriteRune(r)
+    }
+    return b.String()
+}
@@ -0,0 +1,166 @@
+package cachita
+
+import (
+    "fmt"
+    "os"
+    "path/filepath"
+    "sort"
+    "testing"
+    "time"
+
+    "github.com/stretchr/testify/assert"
+)
+
+func TestMatchKey(t *testing.T) {
+    t.Parallel()
+    for _, tc := range []struct {
+        pattern, key string
+        match        bool
+    }{
+        {"user:42:*", "user:42:profile", true},
+        {"user:42:*", "user:42:", true},
+        {"user:42:*", "user:420:profile", false},
+        {"*:profile", "user:42:profile", true},
+        {"user:?", "user:7", true},
+        {"user:?", "user:42", false},
+        {"*a*b", "xaybzab", true},
+        {"*a*b", "xaybza", false},
+        {`user\*`, "user*", true},
+        {`user\*`, "users", false},
+        {"*", "", true},
+        {"ü*", "über", true},
+    } {
+        assert.Equal(t, tc.match, matchKey(tc.pattern, tc.key), "%s %s", tc.pattern, tc.key)
+    }
+}
+
+func TestKeyPatterns(t *testing.T) {
+    t.Parallel()
+    assert.Equal(t, `user:\[1\]:*\*`, redisPattern(`user:[1]:*\*`))
+    assert.Equal(t, `{a\*\?\[b\]\\}`, escapeGlob(`{a*?[b]\}`))
+    assert.True(t, matchKey(escapeGlob(`a*?[b]\`)+"*", `a*?[b]\c`))
+}
+
+func TestMemoryKeys(t *testing.T) {
+    t.Parallel()
+    cacheKeys(NewMemoryCache(time.Hour, time.Hour), t)
+}
+
+func TestFileKeys(t *testing.T) {
+    t.Parallel()
+    path, err := filepath.Abs(filepath.Dir(os.Args[0]))
+    isError(err, t)
+    path = filepath.Join(path, "tmp17/file-cache")
+    isError(os.RemoveAll(path), t)
+    c, err := NewFileCache(path, time.Hour, 0)
+    isError(err, t)
+    cacheKeys(c, t)
+}
+
+func TestMemoryKeys_Sweep(t *testing.T) {
+    t.Parallel()
+    c := newMemoryCache(time.Hour)
+    cacheKeysSweep(c, c.deleteExpired, t)
+}
+
+func TestFileKeys_Sweep(t *testing.T) {
+    t.Parallel()
+    path, err := filepath.Abs(filepath.Dir(os.Args[0]))
+    isError(err, t)
+    path = filepath.Join(path, "tmp21/file-cache")
+    isError(os.RemoveAll(path), t)
+    c, err := NewFileCache(path, time.Hour, 0)
+    isError(err, t)
+    cacheKeysSweep(c, c.(*file).deleteExpired, t)
+}
+
+func TestSqliteKeys(t *testing.T) {
+    t.Parallel()
+    c, err := NewSqlCacheWithOptions(time.Hour, time.Hour, sqliteDb(t, "keys"), "cachita_cache", WithDialect(SQLite), WithMetadata())
+    isError(err, t)
+    cacheKeys(c, t)
+    // the batches of ids without a matching key do not end the iteration
+    isError(c.Put("last", 0, 0), t)
+    it := c.Keys("la*")
+    assert.True(t, it.Next())
+    assert.Equal(t, "last", it.Key())
+    assert.False(t, it.Next())
+    isError(it.Err(), t)
+
+    c, err = NewSqlCacheWithOptions(time.Hour, time.Hour, sqliteDb(t, "keys-nometadata"), "cachita_cache", WithDialect(SQLite))
+    isError(err, t)
+    it = c.Keys("*")
+    assert.False(t, it.Next())
+    assert.Error(t, it.Err())
+}
+
+func TestNamespaceKeys_Sqlite(t *testing.T) {
+    t.Parallel()
+    c, err := NewSqlCacheWithOptions(time.Hour, time.Hour, sqliteDb(t, "namespace-keys"), "cachita_cache", WithDialect(SQLite), WithMetadata())
+    isError(err, t)
+    isError(c.Put("user:1:name", "outside", 0), t)
+    n, err := Namespace(c, "users*")
+    isError(err, t)
+    cacheKeys(n, t)
+}
+
+func cacheKeys(c Cache, t *testing.T) {
+    s := c.(KeyScanner)
+    var want []string
+    for i := 0; i < 250; i++ {
+        k := fmt.Sprintf("user:%d:name", i)
+        isError(c.Put(k, i, 0), t)
+        if i%10 == 4 {
+            want = append(want, k)
+        }
+    }
+    isError(c.Put("user:4:expired", 0, time.Millisecond), t)
+    isError(c.Put("User:4:name", 0, 0), t)
+    time.Sleep(5 * time.Millisecond)
+
+    it := s.Keys("user:*4:*")
+    var keys []string
+    for it.Next() {
+        keys = append(keys, it.Key())
+    }
+    isError(it.Err(), t)
+    sort.Strings(keys)
+    sort.Strings(want)
+    assert.Equal(t, want, keys)
+
+    isError(s.InvalidatePattern("user:*4:name"), t)
+    for _, k := range want {
+        assert.False(t, c.Exists(k), k)
+    }
+    assert.True(t, c.Exists("user:3:name"))
+    assert.True(t, c.Exists("User:4:name"))
+}
+
+// cacheKeysSweep iterates over the keys while they are invalidated, put again and swept
+func cacheKeysSweep(c Cache, sweep func(), t *testing.T) {
+    for i := 0; i < 250; i++ {
+        isError(c.Put(fmt.Sprintf("sweep:%d", i), i, 0), t)
+    }
+    isError(c.Put("sweep:expired", 0, time.Millisecond), t)
+    isError(c.Invalidate("sweep:0"), t)
+    isError(c.Put("sweep:0", 0, 0), t)
+    time.Sleep(5 * time.Millisecond)
+
+    it := c.(KeyScanner).Keys("sweep:*")
+    seen := make(map[string]int)
+    for it.Next() {
+        if len(seen) == 0 {
+            isError(c.Invalidate("sweep:1"), t)
+            sweep()
+            isError(c.Put("sweep:1", 1, 0), t)
+        }
+        seen[it.Key()]++
+    }
+    isError(it.Err(), t)
+    for i := 2; i < 250; i++ {
+        assert.Equal(t, 1, seen[fmt.Sprintf("sweep:%d", i)], i)
+    }
+    assert.Equal(t, 1, seen["sweep:0"])
+    assert.True(t, seen["sweep:1"] <= 1)
+    assert.Zero(t, seen["sweep:expired"])
+}
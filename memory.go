@@ -10,9 +10,15 @@ var mCache Cache
 type memory struct {
     recordsMu sync.RWMutex
     records   map[string]*record
-    tagsMu    sync.Mutex
-    tags      map[string][]string
-    ttl       time.Duration
+    // order lists the keys of records in the order they were added so that Keys walks it by batches,
+    // invalidated records are kept as nil until deleteExpired compacts both
+    order  []string
+    tagsMu sync.Mutex
+    tags   map[string][]string
+    ttl    time.Duration
+    // namespaces keep their entries in their own maps
+    namespacesMu sync.Mutex
+    namespaces   map[string]*memory
 }
 
 func Memory() Cache {
@@ -23,11 +29,7 @@ func Memory() Cache {
 }
 
 func NewMemoryCache(ttl, tickerTtl time.Duration) Cache {
-    c := &memory{
-        records: make(map[string]*record),
-        tags:    make(map[string][]string),
-        ttl:     ttl,
-    }
+    c := newMemoryCache(ttl)
 
     runEvery(tickerTtl, func() {
         c.deleteExpired()
@@ -36,11 +38,19 @@ func NewMemoryCache(ttl, tickerTtl time.Duration) Cache {
     return c
 }
 
+func newMemoryCache(ttl time.Duration) *memory {
+    return &memory{
+        records: make(map[string]*record),
+        tags:    make(map[string][]string),
+        ttl:     ttl,
+    }
+}
+
 func (c *memory) Get(key string, i interface{}) error {
     c.recordsMu.RLock()
-    r, exists := c.records[key]
+    r := c.records[key]
     c.recordsMu.RUnlock()
-    if !exists {
+    if r == nil {
         return ErrNotFound
     }
     if r.ExpiredAt.Before(time.Now()) {
@@ -53,7 +63,7 @@ func (c *memory) Put(key string, i interface{}, ttl time.Duration) error {
     r := &record{Data: i, ExpiredAt: expiredAt(ttl, c.ttl)}
     c.recordsMu.Lock()
     defer c.recordsMu.Unlock()
-    c.records[key] = r
+    c.set(key, r)
     return nil
 }
 
@@ -61,54 +71,146 @@ func (c *memory) Incr(key string, ttl time.Duration) (int64, error) {
     n := int64(1)
     c.recordsMu.Lock()
     defer c.recordsMu.Unlock()
-    r, exists := c.records[key]
-    if !exists || r.ExpiredAt.Before(time.Now()) {
+    r := c.records[key]
+    if r == nil || r.ExpiredAt.Before(time.Now()) {
         r = &record{Data: n, ExpiredAt: expiredAt(ttl, c.ttl)}
     } else {
-        n = r.Data.(int64) + 1
+        i, ok := integer(r.Data)
+        if !ok {
+            return 0, errNotInteger
+        }
+        n = i + 1
     }
     r.Data = n
-    c.records[key] = r
+    c.set(key, r)
     return n, nil
 }
 
+// set adds the key to order when it is not in records, recordsMu must be locked
+func (c *memory) set(key string, r *record) {
+    if _, exists := c.records[key]; !exists {
+        c.order = append(c.order, key)
+    }
+    c.records[key] = r
+}
+
+// remove keeps the key in records until deleteExpired, recordsMu must be locked
+func (c *memory) remove(key string) {
+    if _, exists := c.records[key]; exists {
+        c.records[key] = nil
+    }
+}
+
 func (c *memory) Invalidate(key string) error {
     c.recordsMu.Lock()
     defer c.recordsMu.Unlock()
-    delete(c.records, key)
+    c.remove(key)
     return nil
 }
 
 func (c *memory) Exists(key string) bool {
     c.recordsMu.RLock()
     defer c.recordsMu.RUnlock()
-    r, exists := c.records[key]
-    return exists && r.ExpiredAt.After(time.Now())
+    r := c.records[key]
+    return r != nil && r.ExpiredAt.After(time.Now())
 }
 
+// deleteExpired replaces order rather than compacting it in place since the iterators of Keys read it
 func (c *memory) deleteExpired() {
     records := make(map[string]*record)
     c.recordsMu.Lock()
-    defer c.recordsMu.Unlock()
-    for k, r := range c.records {
-        if r.ExpiredAt.After(time.Now()) {
+    now := time.Now()
+    order := make([]string, 0, len(c.order))
+    for _, k := range c.order {
+        if r := c.records[k]; r != nil && r.ExpiredAt.After(now) {
             records[k] = r
+            order = append(order, k)
         }
     }
-    c.records = records
+    c.records, c.order = records, order
+    c.recordsMu.Unlock()
+
+    for _, n := range c.children() {
+        n.deleteExpired()
+    }
+}
+
+// Flush replaces the maps of the cache and of its namespaces
+func (c *memory) Flush() error {
+    c.recordsMu.Lock()
+    c.records, c.order = make(map[string]*record), nil
+    c.recordsMu.Unlock()
+    c.tagsMu.Lock()
+    c.tags = make(map[string][]string)
+    c.tagsMu.Unlock()
+
+    for _, n := range c.children() {
+        _ = n.Flush()
+    }
+    return nil
+}
+
+// namespace returns the cache of the namespace, its expired entries are deleted with the ones of c
+func (c *memory) namespace(name string) (Cache, error) {
+    c.namespacesMu.Lock()
+    defer c.namespacesMu.Unlock()
+    if c.namespaces == nil {
+        c.namespaces = make(map[string]*memory)
+    }
+    n, exists := c.namespaces[name]
+    if !exists {
+        n = newMemoryCache(c.ttl)
+        c.namespaces[name] = n
+    }
+    return n, nil
+}
+
+func (c *memory) children() []*memory {
+    c.namespacesMu.Lock()
+    defer c.namespacesMu.Unlock()
+    var children []*memory
+    for _, n := range c.namespaces {
+        children = append(children, n)
+    }
+    return children
+}
+
+// Keys walks the order of the keys when the iteration starts, locking the map for each batch
+func (c *memory) Keys(pattern string) KeyIterator {
+    var keys []string
+    started := false
+    return &keyIterator{fetch: func() ([]string, bool, error) {
+        c.recordsMu.RLock()
+        defer c.recordsMu.RUnlock()
+        if !started {
+            keys, started = c.order, true
+        }
+        var matched []string
+        now := time.Now()
+        for n := 0; n < keysBatch && len(keys) > 0; n++ {
+            if r := c.records[keys[0]]; r != nil && r.ExpiredAt.After(now) && matchKey(pattern, keys[0]) {
+                matched = append(matched, keys[0])
+            }
+            keys = keys[1:]
+        }
+        return matched, len(keys) == 0, nil
+    }}
+}
+
+func (c *memory) InvalidatePattern(pattern string) error {
+    return invalidatePattern(c, pattern)
 }
 
 func (c *memory) InvalidateMulti(keys ...string) error {
     c.recordsMu.Lock()
     defer c.recordsMu.Unlock()
     for _, key := range keys {
-        delete(c.records, key)
+        c.remove(key)
     }
     return nil
 }
 
 func (c *memory) Tag(key string, tags ...string) error {
-    tags = uniqueTags(tags)
     c.tagsMu.Lock()
     defer c.tagsMu.Unlock()
     for _, t := range tags {
@@ -133,3 +235,44 @@ func (c *memory) InvalidateTags(tags ...string) error {
 
     return c.InvalidateMulti(keys...)
 }
+
+// KeysByTags matches the tag lists against the records that did not expire
+func (c *memory) KeysByTags(all, any []string) ([]string, error) {
+    c.tagsMu.Lock()
+    keys := matchTags(all, any, func(tag string) []string {
+        return c.tags[tag]
+    })
+    c.tagsMu.Unlock()
+
+    var matched []string
+    for _, k := range keys {
+        if c.Exists(k) {
+            matched = append(matched, k)
+        }
+    }
+    return matched, nil
+}
+
+func (c *memory) InvalidateTagsAll(tags ...string) error {
+    tags = uniqueTags(tags)
+    c.tagsMu.Lock()
+    keys := matchTags(tags, nil, func(tag string) []string {
+        return c.tags[tag]
+    })
+    for _, t := range tags {
+        var kept []string
+        for _, k := range c.tags[t] {
+            if !inArr(keys, k) {
+                kept = append(kept, k)
+            }
+        }
+        if len(kept) == 0 {
+            delete(c.tags, t)
+        } else {
+            c.tags[t] = kept
+        }
+    }
+    c.tagsMu.Unlock()
+
+    return c.InvalidateMulti(keys...)
+}
@@ -3,6 +3,8 @@ package cachita
 import (
     "testing"
     "time"
+
+    "github.com/stretchr/testify/assert"
 )
 
 func TestNewMemoryCache(t *testing.T) {
@@ -15,6 +17,11 @@ func TestMemoryCacheExpires(t *testing.T) {
     cacheExpires(NewMemoryCache(2*time.Minute, 5*time.Millisecond), t, 50*time.Millisecond, 150*time.Millisecond)
 }
 
+func TestMemoryCacheForever(t *testing.T) {
+    t.Parallel()
+    cacheForever(NewMemoryCache(time.Millisecond, 5*time.Millisecond), t)
+}
+
 func TestMemoryCacheWithInt(t *testing.T) {
     t.Parallel()
     cacheWithInt(Memory(), t)
@@ -56,6 +63,21 @@ func TestMemory_Incr(t *testing.T) {
     cacheIncr(Memory(), t)
 }
 
+func TestMemory_IntegerValues(t *testing.T) {
+    t.Parallel()
+    c := NewMemoryCache(time.Hour, time.Hour)
+    isError(c.Put("int", 5, 0), t)
+    n, err := c.Incr("int", 0)
+    isError(err, t)
+    assert.Equal(t, int64(6), n)
+    isError(c.Get("int", &n), t)
+    assert.Equal(t, int64(6), n)
+
+    isError(c.Put("int", "5", 0), t)
+    _, err = c.Incr("int", 0)
+    assert.Equal(t, errNotInteger, err)
+}
+
 func BenchmarkMemory_Incr(b *testing.B) {
     benchmarkCacheIncr(Memory(), b)
 }
@@ -0,0 +1,71 @@
+package cachita
+
+import (
+    "fmt"
+    "strings"
+    "time"
+)
+
+const counterCodec = "counter"
+
+// Metadata describes a cache entry
+type Metadata struct {
+    Key        string
+    CreatedAt  time.Time
+    AccessedAt time.Time // zero when the entry was not read since it was written
+    ExpiredAt  time.Time // zero when the entry is kept forever
+    Size       int64
+    Codec      string // such as msgpack+gzip+aes-gcm+crc32c
+}
+
+// Statter is implemented by the caches returning the metadata of their entries, the file and SQL caches
+type Statter interface {
+    // Stat returns the metadata of the entry of key, expired or not, or ErrNotFound
+    Stat(key string) (Metadata, error)
+}
+
+// WithMetadata stores the original key, creation and last access times, size and codec of the SQL entries,
+// adding their columns to the table, and keeps the access times of the files of file caches up to date.
+// Every Get then writes the access time.
+func WithMetadata() Option {
+    return func(o *options) {
+        o.metadata = true
+    }
+}
+
+// expiry returns the expiry time of Metadata, zero for the entries kept forever
+func expiry(expiredAt time.Time) time.Time {
+    if expiredAt.Before(never) {
+        return expiredAt
+    }
+    return time.Time{}
+}
+
+// codecName describes how a payload was written by the codec
+func codecName(data []byte) string {
+    if len(data) == 0 || data[0] != payloadMagic {
+        return "msgpack"
+    }
+    h, _, err := readHeader(data)
+    if err != nil {
+        return "corrupt"
+    }
+    parts := []string{"msgpack"}
+    if h.flags&flagCompressed != 0 {
+        switch h.compressor {
+        case Gzip.Id():
+            parts = append(parts, "gzip")
+        case Flate.Id():
+            parts = append(parts, "flate")
+        default:
+            parts = append(parts, fmt.Sprintf("compressor-%d", h.compressor))
+        }
+    }
+    if h.flags&flagEncrypted != 0 {
+        parts = append(parts, "aes-gcm")
+    }
+    if h.flags&flagChecksum != 0 {
+        parts = append(parts, "crc32c")
+    }
+    return strings.Join(parts, "+")
+}
@@ -0,0 +1,25 @@
+package cachita
+
+import (
+    "testing"
+
+    "github.com/stretchr/testify/assert"
+)
+
+func TestCodecName(t *testing.T) {
+    t.Parallel()
+    key := make([]byte, 32)
+    for _, tt := range []struct {
+        opts []Option
+        want string
+    }{
+        {nil, "msgpack"},
+        {[]Option{WithChecksum()}, "msgpack+crc32c"},
+        {[]Option{WithCompression(Flate, 0), WithEncryption(EncryptionKey{Id: 1, Key: key}), WithChecksum()}, "msgpack+flate+aes-gcm+crc32c"},
+    } {
+        c := newCodec(t, tt.opts...)
+        data, err := c.marshal("", "(◕‿◕)")
+        isError(err, t)
+        assert.Equal(t, tt.want, codecName(data))
+    }
+}
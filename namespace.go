@@ -0,0 +1,179 @@
+package cachita
+
+import (
+    "net/url"
+    "strconv"
+    "time"
+)
+
+// Flusher is implemented by the caches removing all their entries at once, the caches of cachita and their namespaces
+type Flusher interface {
+    // Flush removes the entries and tags of the cache and of its namespaces
+    Flush() error
+}
+
+// namespacer is implemented by the caches keeping namespaces apart, such as in their own map or directory
+type namespacer interface {
+    namespace(name string) (Cache, error)
+}
+
+// Namespace returns a cache whose keys and tags are isolated from c and its other namespaces, its Flush only
+// removes its own entries. The memory and file caches keep each namespace in its own map or directory, the keys
+// of other caches are prefixed with a generation that Flush increments, so the previous entries expire with their ttl.
+// The entries put Forever before a Flush are only removed by flushing c, or by its InvalidatePattern.
+func Namespace(c Cache, name string) (Cache, error) {
+    if n, ok := c.(namespacer); ok {
+        return n.namespace(name)
+    }
+    // escaping the separator keeps the keys of "a:1" and "a" apart
+    name = url.QueryEscape(name)
+    return &namespace{c: c, prefix: name + ":", generationKey: "cachita:generation:" + name}, nil
+}
+
+// namespace prefixes the keys and tags of c with the name and the generation of the namespace
+type namespace struct {
+    c             Cache
+    prefix        string
+    generationKey string
+}
+
+// keys returns the prefixed keys or tags of the current generation
+func (n *namespace) keys(keys ...string) ([]string, error) {
+    var generation int64
+    if err := n.c.Get(n.generationKey, &generation); err != nil && !IsErrorOk(err) {
+        return nil, err
+    }
+    prefix := n.prefix + strconv.FormatInt(generation, 10) + ":"
+    prefixed := make([]string, len(keys))
+    for i, k := range keys {
+        prefixed[i] = prefix + k
+    }
+    return prefixed, nil
+}
+
+func (n *namespace) Get(key string, i interface{}) error {
+    keys, err := n.keys(key)
+    if err != nil {
+        return err
+    }
+    return n.c.Get(keys[0], i)
+}
+
+func (n *namespace) Put(key string, i interface{}, ttl time.Duration) error {
+    keys, err := n.keys(key)
+    if err != nil {
+        return err
+    }
+    return n.c.Put(keys[0], i, ttl)
+}
+
+func (n *namespace) Incr(key string, ttl time.Duration) (int64, error) {
+    keys, err := n.keys(key)
+    if err != nil {
+        return 0, err
+    }
+    return n.c.Incr(keys[0], ttl)
+}
+
+func (n *namespace) Tag(key string, tags ...string) error {
+    keys, err := n.keys(append([]string{key}, tags...)...)
+    if err != nil {
+        return err
+    }
+    return n.c.Tag(keys[0], keys[1:]...)
+}
+
+func (n *namespace) Exists(key string) bool {
+    keys, err := n.keys(key)
+    return err == nil && n.c.Exists(keys[0])
+}
+
+func (n *namespace) Invalidate(key string) error {
+    keys, err := n.keys(key)
+    if err != nil {
+        return err
+    }
+    return n.c.Invalidate(keys[0])
+}
+
+func (n *namespace) InvalidateMulti(keys ...string) error {
+    keys, err := n.keys(keys...)
+    if err != nil {
+        return err
+    }
+    return n.c.InvalidateMulti(keys...)
+}
+
+func (n *namespace) InvalidateTags(tags ...string) error {
+    tags, err := n.keys(tags...)
+    if err != nil {
+        return err
+    }
+    return n.c.InvalidateTags(tags...)
+}
+
+// Keys scans the keys of c prefixed by the current generation
+func (n *namespace) Keys(pattern string) KeyIterator {
+    s, ok := n.c.(KeyScanner)
+    if !ok {
+        return errKeys(errNoKeys)
+    }
+    prefix, err := n.keys("")
+    if err != nil {
+        return errKeys(err)
+    }
+    it := s.Keys(escapeGlob(prefix[0]) + pattern)
+    return &keyIterator{fetch: func() ([]string, bool, error) {
+        var keys []string
+        for len(keys) < keysBatch {
+            if !it.Next() {
+                return keys, true, it.Err()
+            }
+            keys = append(keys, it.Key()[len(prefix[0]):])
+        }
+        return keys, false, nil
+    }}
+}
+
+func (n *namespace) InvalidatePattern(pattern string) error {
+    return invalidatePattern(n, pattern)
+}
+
+// KeysByTags queries the prefixed tags of c and strips the prefix of the keys
+func (n *namespace) KeysByTags(all, any []string) ([]string, error) {
+    q, ok := n.c.(TagQuerier)
+    if !ok {
+        return nil, errNoTagQueries
+    }
+    tags, err := n.keys(append(append([]string{""}, all...), any...)...)
+    if err != nil {
+        return nil, err
+    }
+    keys, err := q.KeysByTags(tags[1:len(all)+1], tags[len(all)+1:])
+    if err != nil {
+        return nil, err
+    }
+    for i, k := range keys {
+        keys[i] = k[len(tags[0]):]
+    }
+    return keys, nil
+}
+
+func (n *namespace) InvalidateTagsAll(tags ...string) error {
+    q, ok := n.c.(TagQuerier)
+    if !ok {
+        return errNoTagQueries
+    }
+    tags, err := n.keys(tags...)
+    if err != nil {
+        return err
+    }
+    return q.InvalidateTagsAll(tags...)
+}
+
+// Flush starts a new generation, the namespaces of the namespace are flushed too as their generations
+// are kept in the previous one. The entries of the previous generation are left to expire.
+func (n *namespace) Flush() error {
+    _, err := n.c.Incr(n.generationKey, Forever)
+    return err
+}
@@ -0,0 +1,101 @@
+package cachita
+
+import (
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+
+    "github.com/stretchr/testify/assert"
+)
+
+func TestNamespaceKeys(t *testing.T) {
+    t.Parallel()
+    // hides the namespaces of the memory cache
+    c := struct{ Cache }{NewMemoryCache(time.Hour, time.Hour)}
+    a, err := Namespace(c, "a:1")
+    isError(err, t)
+    b, err := Namespace(c, "a")
+    isError(err, t)
+    keys, err := a.(*namespace).keys("k")
+    isError(err, t)
+    assert.Equal(t, []string{"a%3A1:0:k"}, keys)
+    keys, err = b.(*namespace).keys("1:0:k")
+    isError(err, t)
+    assert.Equal(t, []string{"a:0:1:0:k"}, keys)
+}
+
+func TestMemoryNamespace(t *testing.T) {
+    t.Parallel()
+    cacheNamespace(NewMemoryCache(time.Hour, time.Hour), t)
+}
+
+func TestFileNamespace(t *testing.T) {
+    t.Parallel()
+    path, err := filepath.Abs(filepath.Dir(os.Args[0]))
+    isError(err, t)
+    path = filepath.Join(path, "tmp16/file-cache")
+    isError(os.RemoveAll(path), t)
+    c, err := NewFileCache(path, time.Hour, 0)
+    isError(err, t)
+    cacheNamespace(c, t)
+
+    // the files of the namespaces are not indexed by the cache
+    n, err := Namespace(c, "users")
+    isError(err, t)
+    isError(n.Put("k", "v", 0), t)
+    missing, unindexed, err := VerifyFileIndex(path)
+    isError(err, t)
+    assert.Empty(t, missing)
+    assert.Empty(t, unindexed)
+}
+
+func TestSqliteNamespace(t *testing.T) {
+    t.Parallel()
+    c, err := NewSqlCacheWithOptions(time.Hour, time.Hour, sqliteDb(t, "namespace"), "cachita_cache", WithDialect(SQLite))
+    isError(err, t)
+    cacheNamespace(c, t)
+}
+
+func cacheNamespace(c Cache, t *testing.T) {
+    users, err := Namespace(c, "users")
+    isError(err, t)
+    admins, err := Namespace(c, "admins")
+    isError(err, t)
+    for i, cache := range []Cache{c, users, admins} {
+        isError(cache.Put("k", i, 0), t)
+        isError(cache.Tag("k", "t"), t)
+    }
+    var n int
+    isError(users.Get("k", &n), t)
+    assert.Equal(t, 1, n)
+    again, err := Namespace(c, "users")
+    isError(err, t)
+    isError(again.Get("k", &n), t)
+    assert.Equal(t, 1, n)
+
+    isError(users.InvalidateTags("t"), t)
+    assert.False(t, users.Exists("k"))
+    assert.True(t, admins.Exists("k"))
+    assert.True(t, c.Exists("k"))
+
+    nested, err := Namespace(admins, "nested")
+    isError(err, t)
+    isError(nested.Put("k", 3, 0), t)
+    isError(users.Put("k", 1, 0), t)
+    isError(admins.(Flusher).Flush(), t)
+    assert.False(t, admins.Exists("k"))
+    assert.False(t, nested.Exists("k"))
+    assert.True(t, users.Exists("k"))
+    assert.True(t, c.Exists("k"))
+    isError(admins.Put("k", 2, 0), t)
+    assert.True(t, admins.Exists("k"))
+
+    isError(c.(Flusher).Flush(), t)
+    assert.False(t, c.Exists("k"))
+    assert.False(t, users.Exists("k"))
+    assert.False(t, admins.Exists("k"))
+    isError(users.Put("k", 1, 0), t)
+    isError(users.Get("k", &n), t)
+    assert.Equal(t, 1, n)
+}
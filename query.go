@@ -0,0 +1,69 @@
+package cachita
+
+import (
+    "strings"
+)
+
+// maxParams keeps the statements below the bind parameter limits of the drivers,
+// SQLite before 3.32 allows 999 parameters, Postgres and MySQL 65535
+var maxParams = 999
+
+// query builds a statement for a dialect, identifiers are quoted and arguments get numbered placeholders
+type query struct {
+    d    Dialect
+    sql  strings.Builder
+    args []interface{}
+}
+
+func newQuery(d Dialect) *query {
+    return &query{d: d}
+}
+
+// raw appends s as is, it must never contain user input
+func (q *query) raw(s string) *query {
+    q.sql.WriteString(s)
+    return q
+}
+
+func (q *query) ident(name string) *query {
+    q.sql.WriteString(q.d.Quote(name))
+    return q
+}
+
+func (q *query) arg(v interface{}) *query {
+    q.args = append(q.args, v)
+    q.sql.WriteString(q.d.Placeholder(len(q.args)))
+    return q
+}
+
+// in appends an IN list with a placeholder for each value
+func (q *query) in(values []interface{}) *query {
+    q.sql.WriteString("IN (")
+    for i, v := range values {
+        if i > 0 {
+            q.sql.WriteString(", ")
+        }
+        q.arg(v)
+    }
+    q.sql.WriteString(")")
+    return q
+}
+
+func (q *query) String() string {
+    return q.sql.String()
+}
+
+// chunk calls f with consecutive parts of values holding at most maxParams values
+func chunk(values []interface{}, f func(part []interface{}) error) error {
+    for len(values) > 0 {
+        n := maxParams
+        if len(values) < n {
+            n = len(values)
+        }
+        if err := f(values[:n]); err != nil {
+            return err
+        }
+        values = values[n:]
+    }
+    return nil
+}
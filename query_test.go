@@ -0,0 +1,40 @@
+package cachita
+
+import (
+    "testing"
+
+    "github.com/stretchr/testify/assert"
+)
+
+func TestQuery(t *testing.T) {
+    for _, tt := range []struct {
+        d    Dialect
+        want string
+    }{
+        {Postgres, `DELETE FROM "t""x" WHERE expired_at <= $1 AND id IN ($2, $3)`},
+        {MySQL, "DELETE FROM `t\"x` WHERE expired_at <= ? AND id IN (?, ?)"},
+        {SQLite, `DELETE FROM "t""x" WHERE expired_at <= ?1 AND id IN (?2, ?3)`},
+    } {
+        q := newQuery(tt.d).raw("DELETE FROM ").ident(`t"x`).raw(" WHERE expired_at <= ").arg(1).raw(" AND id ").in([]interface{}{"a", "b"})
+        assert.Equal(t, tt.want, q.String())
+        assert.Equal(t, []interface{}{1, "a", "b"}, q.args)
+    }
+}
+
+func TestChunk(t *testing.T) {
+    defer func(n int) { maxParams = n }(maxParams)
+    maxParams = 2
+
+    var parts [][]interface{}
+    err := chunk([]interface{}{1, 2, 3, 4, 5}, func(part []interface{}) error {
+        parts = append(parts, part)
+        return nil
+    })
+    isError(err, t)
+    assert.Equal(t, [][]interface{}{{1, 2}, {3, 4}, {5}}, parts)
+
+    err = chunk([]interface{}{1, 2, 3}, func(part []interface{}) error {
+        return ErrNotFound
+    })
+    assert.Equal(t, ErrNotFound, err)
+}
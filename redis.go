@@ -2,6 +2,10 @@ package cachita
 
 import (
     "fmt"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
     "time"
 
     "github.com/mediocregopher/radix/v3"
@@ -10,10 +14,39 @@ import (
 
 var rCache Cache
 
+// redisNodePoolSize is the size of the pools of the nodes of clusters and of the primaries of sentinels, as in radix
+const redisNodePoolSize = 20
+
 type redis struct {
-    pool   *radix.Pool
-    prefix string
-    ttl    time.Duration
+    client  radix.Client
+    prefix  string // wrapped in braces as a hash tag for clusters
+    ttl     time.Duration
+    codec   *codec
+    onError func(err error)
+    // spread is set for the cluster caches WithRedisSpreadKeys, whose keys are in different slots
+    spread bool
+}
+
+// redisSlots is the number of hash slots of a Redis Cluster
+const redisSlots = 16384
+
+var (
+    slotTagsOnce sync.Once
+    slotTags     [redisSlots]string
+)
+
+// slotTag returns a hash tag of slot, the shortest base 36 number hashing to it
+func slotTag(slot uint16) string {
+    slotTagsOnce.Do(func() {
+        for n, found := int64(0), 0; found < redisSlots; n++ {
+            h := strconv.FormatInt(n, 36)
+            if s := radix.ClusterSlot([]byte(h)); slotTags[s] == "" {
+                slotTags[s] = h
+                found++
+            }
+        }
+    })
+    return slotTags[slot]
 }
 
 func Redis(addr string) (Cache, error) {
@@ -27,79 +60,184 @@ func Redis(addr string) (Cache, error) {
     return rCache, nil
 }
 
-func NewRedisCache(ttl time.Duration, poolSize int, prefix, addr string) (Cache, error) {
-    pool, err := radix.NewPool("tcp", addr, poolSize)
+// NewRedisCache creates a cache connected to addr, a host:port address or a URL as NewRedisCacheFromURL accepts
+// whose settings are overridden WithRedisConn
+func NewRedisCache(ttl time.Duration, poolSize int, prefix, addr string, opts ...Option) (Cache, error) {
+    if strings.Contains(addr, "://") {
+        a, conn, _, err := parseRedisURL(addr)
+        if err != nil {
+            return nil, err
+        }
+        addr, opts = a, append([]Option{WithRedisConn(conn)}, opts...)
+    }
+    o, err := newOptions(opts)
     if err != nil {
         return nil, err
     }
-
-    c := &redis{
-        pool:   pool,
-        prefix: prefix,
-        ttl:    ttl,
+    pool, err := radix.NewPool("tcp", addr, poolSize, radix.PoolConnFunc(o.redisConn.dial))
+    if err != nil {
+        return nil, err
     }
+    c := newRedisCache(ttl, prefix, pool, o)
+    c.loadScripts()
+    return c, nil
+}
 
+// NewRedisClusterCache creates a cache in a Redis Cluster. Its keys and tags share the hash tag {prefix} so that
+// the scripts handling a key and its tags run on a single node: all the entries of the cache live in one slot,
+// so the cache is limited to the memory and the throughput of one node, and only caches with different prefixes
+// spread over the cluster. WithRedisSpreadKeys spreads the keys of a cache over the slots instead.
+func NewRedisClusterCache(ttl time.Duration, prefix string, addrs []string, opts ...Option) (Cache, error) {
+    o, err := newOptions(opts)
+    if err != nil {
+        return nil, err
+    }
+    cluster, err := radix.NewCluster(addrs, radix.ClusterPoolFunc(o.redisConn.pool(redisNodePoolSize)))
+    if err != nil {
+        return nil, err
+    }
+    if !o.redisSpread {
+        prefix = "{" + prefix + "}"
+    }
+    c := newRedisCache(ttl, prefix, cluster, o)
+    c.spread = o.redisSpread
+    c.loadScripts()
     return c, nil
 }
 
-func (c *redis) Get(key string, i interface{}) error {
-    s := i
-    isInt := isInt(i)
-    var data []byte
-    if !isInt {
-        s = &data
+// WithRedisSpreadKeys spreads the keys of a Redis Cluster cache over the slots of the cluster instead of keeping
+// them in the slot of its prefix. A tag then has a tag set in each slot of its keys and a set indexing these slots:
+// Tag adds the slot of the key to the index of each tag, and InvalidateTags, KeysByTags and InvalidateTagsAll run
+// their script once per slot of the tags, so they are atomic per slot only.
+func WithRedisSpreadKeys() Option {
+    return func(o *options) {
+        o.redisSpread = true
     }
-    err := c.pool.Do(radix.FlatCmd(s, "GET", c.k(key)))
+}
+
+// NewRedisSentinelCache creates a cache in the Redis primary named primaryName by the sentinels
+// and follows its failovers
+func NewRedisSentinelCache(ttl time.Duration, prefix, primaryName string, sentinelAddrs []string, opts ...Option) (Cache, error) {
+    o, err := newOptions(opts)
     if err != nil {
-        return err
+        return nil, err
+    }
+    sentinel, err := radix.NewSentinel(primaryName, sentinelAddrs, radix.SentinelPoolFunc(o.redisConn.pool(redisNodePoolSize)))
+    if err != nil {
+        return nil, err
     }
+    c := newRedisCache(ttl, prefix, sentinel, o)
+    c.loadScripts()
+    return c, nil
+}
 
-    if isInt {
-        i = s
-        return nil
+func newRedisCache(ttl time.Duration, prefix string, client radix.Client, o *options) *redis {
+    c := &redis{
+        client:  client,
+        prefix:  prefix,
+        ttl:     ttl,
+        codec:   o.codec,
+        onError: o.onError,
+    }
+    if o.tagPrune > 0 {
+        runEvery(o.tagPrune, func() {
+            if err := c.prune(); err != nil {
+                c.onError(fmt.Errorf("pruning the tags of %s: %v", prefix, err))
+            }
+        })
     }
+    return c
+}
+
+// WithTagPrune removes the keys that expired from the Redis tag sets every interval, one hour by default, the
+// tag sets left empty are deleted. Tag sets never expire so that the keys put again with a longer ttl stay
+// tagged, an interval of 0 stops pruning and the sets then accumulate the keys that expired.
+func WithTagPrune(interval time.Duration) Option {
+    return func(o *options) {
+        o.tagPrune = interval
+    }
+}
 
-    data = *s.(*[]byte)
+func (c *redis) Get(key string, i interface{}) error {
+    var data []byte
+    err := c.client.Do(radix.Cmd(&data, "GET", c.k(key)))
+    if err != nil {
+        return err
+    }
     if data == nil {
         return ErrNotFound
     }
-    return msgpack.Unmarshal(data, i)
+
+    err = c.decode(data, i)
+    if err == ErrCorrupt && c.codec.invalidateCorrupt {
+        _ = c.Invalidate(key)
+    }
+    return err
 }
 
 func (c *redis) Put(key string, i interface{}, ttl time.Duration) error {
-    s := i
-    if !isInt(i) {
-        data, err := msgpack.Marshal(i)
-        if err != nil {
-            return err
-        }
-        s = &data
+    data, err := c.encode(i)
+    if err != nil {
+        return err
     }
-
-    return c.pool.Do(radix.FlatCmd(nil, "SETEX", c.k(key), calculateTtl(ttl, c.ttl).Seconds(), s))
+    ms := c.pttl(ttl)
+    if ms == -1 {
+        return c.client.Do(radix.FlatCmd(nil, "SET", c.k(key), data))
+    }
+    return c.client.Do(radix.FlatCmd(nil, "SET", c.k(key), data, "PX", ms))
 }
 
+// Incr increments the decimal string of INCR, which is stored in plain text even when the codec encrypts
 func (c *redis) Incr(key string, ttl time.Duration) (int64, error) {
-    k := c.k(key)
-    incr := radix.NewEvalScript(1, `
-		local n = redis.call("incr",KEYS[1])
-        if tonumber(n) == 1 then
-    		redis.call("expire",KEYS[1],ARGV[1])
-		end
-		return n
-`)
     var n int64
-    err := c.pool.Do(incr.Cmd(&n, k, fmt.Sprintf("%.0f", calculateTtl(ttl, c.ttl).Seconds())))
+    err := c.eval(incrScript, &n, []string{c.k(key)}, strconv.FormatInt(c.pttl(ttl), 10))
+    if err != nil && c.codec.encrypts() && strings.Contains(err.Error(), "not an integer") {
+        if err = c.decryptCounter(key); err == nil {
+            err = c.eval(incrScript, &n, []string{c.k(key)}, strconv.FormatInt(c.pttl(ttl), 10))
+        }
+    }
     return n, err
 }
 
+// decryptCounter replaces an integer encrypted by Put with its decimal string so that INCR increments it
+func (c *redis) decryptCounter(key string) error {
+    var data []byte
+    mn := radix.MaybeNil{Rcv: &data}
+    if err := c.client.Do(radix.Cmd(&mn, "GET", c.k(key))); err != nil || mn.Nil {
+        return err
+    }
+    var v interface{}
+    if err := c.codec.unmarshal(data, &v); err != nil {
+        return err
+    }
+    n, ok := integer(v)
+    if !ok {
+        return errNotInteger
+    }
+    return c.eval(replaceScript, nil, []string{c.k(key)}, string(data), strconv.FormatInt(n, 10))
+}
+
+// pttl returns the ttl in milliseconds, rounded up as Redis expires keys of 0 milliseconds immediately,
+// or -1 for the keys kept forever
+func (c *redis) pttl(ttl time.Duration) int64 {
+    ttl = calculateTtl(ttl, c.ttl)
+    if ttl == Forever {
+        return -1
+    }
+    ms := int64((ttl + time.Millisecond - 1) / time.Millisecond)
+    if ms < 1 {
+        ms = 1
+    }
+    return ms
+}
+
 func (c *redis) Invalidate(key string) error {
-    return c.pool.Do(radix.Cmd(nil, "DEL", c.k(key)))
+    return c.client.Do(radix.Cmd(nil, "DEL", c.k(key)))
 }
 
 func (c *redis) Exists(key string) bool {
     var b bool
-    err := c.pool.Do(radix.Cmd(&b, "EXISTS", c.k(key)))
+    err := c.client.Do(radix.Cmd(&b, "EXISTS", c.k(key)))
     return err == nil && b
 }
 
@@ -111,21 +249,70 @@ func (c *redis) t(tag string) string {
     return fmt.Sprintf("%s:tags::%s", c.prefix, tag)
 }
 
-func isInt(i interface{}) bool {
-    switch i.(type) {
-    case *int:
-    case *int8:
-    case *int16:
-    case *int32:
-    case *int64:
-    case int:
-    case int8:
-    case int16:
-    case int32:
-    case int64:
-    default:
+// kPattern returns the SCAN pattern of the keys matching pattern, the prefix is matched literally
+func (c *redis) kPattern(pattern string) string {
+    return fmt.Sprintf("%s:keys::%s", escapeGlob(c.prefix), pattern)
+}
+
+// st returns the tag set of tag in slot, for spread caches
+func (c *redis) st(slot uint16, tag string) string {
+    return fmt.Sprintf("%s:tags:{%s}:%s", c.prefix, slotTag(slot), tag)
+}
+
+// ts returns the set of the slots of the tag sets of tag, for spread caches
+func (c *redis) ts(tag string) string {
+    return fmt.Sprintf("%s:slots::%s", c.prefix, tag)
+}
+
+// tPattern returns the SCAN pattern of the tag sets, of every slot for spread caches
+func (c *redis) tPattern() string {
+    return escapeGlob(c.prefix) + ":tags:*"
+}
+
+// sPattern returns the SCAN pattern of the slot sets of spread caches
+func (c *redis) sPattern() string {
+    return escapeGlob(c.prefix) + ":slots::*"
+}
+
+// encode stores integers as decimal strings, the format of INCR, so that Put and Incr share their values, unless
+// the codec encrypts. Other values are encoded by the codec, whose payloads never parse as a decimal integer.
+func (c *redis) encode(i interface{}) ([]byte, error) {
+    if n, ok := integer(i); ok && !c.codec.encrypts() {
+        return []byte(strconv.FormatInt(n, 10)), nil
+    }
+    return c.codec.marshal("", i)
+}
+
+// decode reads the integers stored by encode or Incr into any numeric target, as msgpack does for other values
+func (c *redis) decode(data []byte, i interface{}) error {
+    if !isDecimal(data) {
+        return c.codec.unmarshal(data, i)
+    }
+    n, err := strconv.ParseInt(string(data), 10, 64)
+    if err != nil {
+        return err
+    }
+    data, err = msgpack.Marshal(n)
+    if err != nil {
+        return err
+    }
+    return msgpack.Unmarshal(data, i)
+}
+
+// isDecimal reports whether data is an integer written by INCR or encode. A msgpack payload starting
+// with a digit or a minus sign is a single byte positive integer, which encode writes in decimal.
+func isDecimal(data []byte) bool {
+    if len(data) > 0 && data[0] == '-' {
+        data = data[1:]
+    }
+    if len(data) == 0 {
         return false
     }
+    for _, b := range data {
+        if b < '0' || b > '9' {
+            return false
+        }
+    }
     return true
 }
 
@@ -134,46 +321,295 @@ func (c *redis) InvalidateMulti(keys ...string) error {
     for _, k := range keys {
         rKeys = append(rKeys, c.k(k))
     }
-    return c.pool.Do(radix.Cmd(nil, "DEL", rKeys...))
+    return c.del(rKeys...)
 }
 
-func (c *redis) Tag(key string, tags ...string) (err error) {
-    tags = uniqueTags(tags)
-    rKey := c.k(key)
-    var cmds []radix.CmdAction
+// del deletes keys, by slot when they are spread over the slots of a cluster
+func (c *redis) del(keys ...string) error {
+    if len(keys) == 0 {
+        return nil
+    }
+    if !c.spread {
+        return c.client.Do(radix.Cmd(nil, "DEL", keys...))
+    }
+    slots := make(map[uint16][]string)
+    for _, k := range keys {
+        slot := radix.ClusterSlot([]byte(k))
+        slots[slot] = append(slots[slot], k)
+    }
+    for _, keys := range slots {
+        if err := c.client.Do(radix.Cmd(nil, "DEL", keys...)); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// Tag adds key to the tag sets, which keep the keys that expired until they are invalidated or pruned
+func (c *redis) Tag(key string, tags ...string) error {
+    if len(tags) == 0 {
+        return nil
+    }
+    keys := []string{c.k(key)}
+    if !c.spread {
+        for _, t := range tags {
+            keys = append(keys, c.t(t))
+        }
+        return c.eval(tagScript, nil, keys)
+    }
+    slot := radix.ClusterSlot([]byte(keys[0]))
     for _, t := range tags {
-        cmds = append(cmds, radix.FlatCmd(nil, "SADD", c.t(t), rKey))
+        keys = append(keys, c.st(slot, t))
+    }
+    if err := c.eval(tagScript, nil, keys); err != nil {
+        return err
+    }
+    // the slot is indexed after its tag sets are written, see pruneSlots
+    for _, t := range tags {
+        if err := c.client.Do(radix.Cmd(nil, "SADD", c.ts(t), strconv.Itoa(int(slot)))); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// slotTagSets returns the tag sets of tags in each slot holding keys tagged with every tag of all and with one
+// of any, or in the slot of the prefix for the caches that are not spread
+func (c *redis) slotTagSets(tags, all, any []string) ([][]string, error) {
+    if !c.spread {
+        var sets []string
+        for _, t := range tags {
+            sets = append(sets, c.t(t))
+        }
+        return [][]string{sets}, nil
+    }
+    var err error
+    matched := matchTags(all, any, func(tag string) []string {
+        var slots []string
+        if err == nil {
+            err = c.client.Do(radix.Cmd(&slots, "SMEMBERS", c.ts(tag)))
+        }
+        return slots
+    })
+    if err != nil {
+        return nil, err
+    }
+    sets := make([][]string, len(matched))
+    for i, m := range matched {
+        slot, err := strconv.ParseUint(m, 10, 16)
+        if err != nil {
+            return nil, err
+        }
+        for _, t := range tags {
+            sets[i] = append(sets[i], c.st(uint16(slot), t))
+        }
     }
-    return c.pool.Do(radix.Pipeline(cmds...))
+    return sets, nil
 }
 
+// InvalidateTags deletes the keys of the tags and the tag sets atomically, per slot for spread caches
 func (c *redis) InvalidateTags(tags ...string) error {
     tags = uniqueTags(tags)
-    var rKeys, rTags []string
-    for _, t := range tags {
+    if len(tags) == 0 {
+        return nil
+    }
+    sets, err := c.slotTagSets(tags, nil, tags)
+    if err != nil {
+        return err
+    }
+    for _, rTags := range sets {
+        if err := c.eval(invalidateTagsScript, nil, rTags); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// KeysByTags intersects the tag sets with SINTER, the keys of the tag sets that expired are skipped
+func (c *redis) KeysByTags(all, any []string) ([]string, error) {
+    all, any = uniqueTags(all), uniqueTags(any)
+    if len(all) == 0 && len(any) == 0 {
+        return nil, nil
+    }
+    sets, err := c.slotTagSets(append(append([]string(nil), all...), any...), all, any)
+    if err != nil {
+        return nil, err
+    }
+    var keys []string
+    for _, rTags := range sets {
+        var slotKeys []string
+        if err := c.eval(tagQueryScript, &slotKeys, rTags, strconv.Itoa(len(all))); err != nil {
+            return nil, err
+        }
+        keys = append(keys, slotKeys...)
+    }
+    prefix := len(c.k(""))
+    for i, k := range keys {
+        keys[i] = k[prefix:]
+    }
+    sort.Strings(keys)
+    return keys, nil
+}
+
+// InvalidateTagsAll deletes the keys of the intersection of the tag sets atomically, per slot for spread caches
+func (c *redis) InvalidateTagsAll(tags ...string) error {
+    tags = uniqueTags(tags)
+    if len(tags) == 0 {
+        return nil
+    }
+    sets, err := c.slotTagSets(tags, tags, nil)
+    if err != nil {
+        return err
+    }
+    for _, rTags := range sets {
+        if err := c.eval(invalidateTagsAllScript, nil, rTags); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// Keys scans the keys with SCAN MATCH, which may return a key more than once
+func (c *redis) Keys(pattern string) KeyIterator {
+    s := c.scanner(radix.ScanOpts{Command: "SCAN", Pattern: c.kPattern(redisPattern(pattern)), Count: keysBatch})
+    prefix := len(c.k(""))
+    return &keyIterator{fetch: func() ([]string, bool, error) {
         var keys []string
-        t = c.t(t)
-        err := c.pool.Do(radix.Cmd(&keys, "SMEMBERS", t))
-        if err != nil {
+        var key string
+        for len(keys) < keysBatch {
+            if !s.Next(&key) {
+                return keys, true, s.Close()
+            }
+            keys = append(keys, key[prefix:])
+        }
+        return keys, false, nil
+    }}
+}
+
+func (c *redis) InvalidatePattern(pattern string) error {
+    return invalidatePattern(c, pattern)
+}
+
+// Flush deletes the keys and tags of the cache, scanning them in batches so that Redis is not blocked.
+// The keys written while flushing may be kept.
+func (c *redis) Flush() error {
+    for _, pattern := range []string{c.kPattern("*"), c.tPattern(), c.sPattern()} {
+        if err := c.deleteScan(pattern); err != nil {
             return err
         }
-        rKeys = append(rKeys, keys...)
-        rTags = append(rTags, t)
     }
+    return nil
+}
 
-    go func() {
-        var cmds []radix.CmdAction
-        for _, k := range rKeys {
-            for _, t := range rTags {
-                cmds = append(cmds, radix.FlatCmd(nil, "SREM", t, k))
+// deleteScan deletes the keys matching pattern by batches
+func (c *redis) deleteScan(pattern string) error {
+    s := c.scanner(radix.ScanOpts{Command: "SCAN", Pattern: pattern, Count: 1000})
+    var keys []string
+    var key string
+    for s.Next(&key) {
+        keys = append(keys, key)
+        if len(keys) == 1000 {
+            if err := c.del(keys...); err != nil {
+                _ = s.Close()
+                return err
             }
+            keys = keys[:0]
         }
-        _ = c.pool.Do(radix.Pipeline(cmds...))
-    }()
+    }
+    if err := s.Close(); err != nil {
+        return err
+    }
+    return c.del(keys...)
+}
 
-    if len(rKeys) == 0 {
+// prune removes the keys that do not exist from all the tag sets, then the slots without tag sets from the slot
+// sets of spread caches
+func (c *redis) prune() error {
+    if err := c.scanEach(c.tPattern(), c.pruneTag); err != nil {
+        return err
+    }
+    if !c.spread {
         return nil
     }
+    return c.scanEach(c.sPattern(), c.pruneSlots)
+}
 
-    return c.pool.Do(radix.Cmd(nil, "DEL", rKeys...))
+// scanEach calls f with each key matching pattern
+func (c *redis) scanEach(pattern string, f func(key string) error) error {
+    s := c.scanner(radix.ScanOpts{Command: "SCAN", Pattern: pattern, Count: 100})
+    var key string
+    for s.Next(&key) {
+        if err := f(key); err != nil {
+            _ = s.Close()
+            return err
+        }
+    }
+    return s.Close()
+}
+
+// pruneSlots removes the slots whose tag set does not exist from slots, the slot set of a tag. A tag set written
+// by Tag meanwhile keeps its slot, added back by Tag after writing it or by the check following SREM.
+func (c *redis) pruneSlots(slots string) error {
+    tag := slots[len(c.ts("")):]
+    var members []string
+    if err := c.client.Do(radix.Cmd(&members, "SMEMBERS", slots)); err != nil {
+        return err
+    }
+    for _, m := range members {
+        slot, err := strconv.ParseUint(m, 10, 16)
+        if err != nil {
+            return err
+        }
+        set := c.st(uint16(slot), tag)
+        var exists bool
+        if err := c.client.Do(radix.Cmd(&exists, "EXISTS", set)); err != nil {
+            return err
+        }
+        if exists {
+            continue
+        }
+        if err := c.client.Do(radix.Cmd(nil, "SREM", slots, m)); err != nil {
+            return err
+        }
+        if err := c.client.Do(radix.Cmd(&exists, "EXISTS", set)); err != nil {
+            return err
+        }
+        if exists {
+            if err := c.client.Do(radix.Cmd(nil, "SADD", slots, m)); err != nil {
+                return err
+            }
+        }
+    }
+    return nil
+}
+
+// scanner scans every primary of a cluster for SCAN, other scans are sent to the node of their key
+func (c *redis) scanner(o radix.ScanOpts) radix.Scanner {
+    if cluster, ok := c.client.(*radix.Cluster); ok && o.Command == "SCAN" {
+        return cluster.NewScanner(o)
+    }
+    return radix.NewScanner(c.client, o)
+}
+
+func (c *redis) pruneTag(tag string) error {
+    s := c.scanner(radix.ScanOpts{Command: "SSCAN", Key: tag, Count: 100})
+    var keys []string
+    var key string
+    for s.Next(&key) {
+        keys = append(keys, key)
+        if len(keys) == 100 {
+            if err := c.eval(pruneScript, nil, []string{tag}, keys...); err != nil {
+                _ = s.Close()
+                return err
+            }
+            keys = keys[:0]
+        }
+    }
+    if err := s.Close(); err != nil {
+        return err
+    }
+    if len(keys) == 0 {
+        return nil
+    }
+    return c.eval(pruneScript, nil, []string{tag}, keys...)
 }
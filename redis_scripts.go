@@ -0,0 +1,157 @@
+package cachita
+
+import (
+    "crypto/sha1"
+    "encoding/hex"
+    "fmt"
+    "strconv"
+    "strings"
+
+    "github.com/mediocregopher/radix/v3"
+)
+
+// script is a Lua script of cachita, loaded on the Redis nodes by SCRIPT LOAD and run by its SHA1 with EVALSHA
+type script struct {
+    src, sha string
+}
+
+func newScript(src string) *script {
+    sum := sha1.Sum([]byte(src))
+    return &script{src: src, sha: hex.EncodeToString(sum[:])}
+}
+
+var (
+    // tagScript adds KEYS[1] to the tag sets of KEYS[2..]. Tag sets never expire since their keys can be put
+    // again with a longer ttl without being tagged again, the sets given a ttl by earlier versions are persisted.
+    tagScript = newScript(`
+for i = 2, #KEYS do
+    redis.call("SADD", KEYS[i], KEYS[1])
+    redis.call("PERSIST", KEYS[i])
+end
+return 0
+`)
+
+    // incrScript increments KEYS[1] and sets its expiry to ARGV[1] milliseconds when it is created, -1 never expires
+    incrScript = newScript(`
+local n = redis.call("INCR", KEYS[1])
+local ttl = tonumber(ARGV[1])
+if n == 1 and ttl > 0 then
+    redis.call("PEXPIRE", KEYS[1], ttl)
+end
+return n
+`)
+
+    // replaceScript sets KEYS[1] to ARGV[2] keeping its expiry if its value is still ARGV[1]
+    replaceScript = newScript(`
+if redis.call("GET", KEYS[1]) ~= ARGV[1] then
+    return 0
+end
+local ttl = redis.call("PTTL", KEYS[1])
+redis.call("SET", KEYS[1], ARGV[2])
+if ttl > 0 then
+    redis.call("PEXPIRE", KEYS[1], ttl)
+end
+return 1
+`)
+
+    // invalidateTagsScript deletes the members of the tag sets of KEYS and the sets,
+    // in batches as unpack is limited by the size of the Lua stack
+    invalidateTagsScript = newScript(`
+local n = 0
+for _, tag in ipairs(KEYS) do
+    local keys = redis.call("SMEMBERS", tag)
+    for i = 1, #keys, 1000 do
+        n = n + redis.call("DEL", unpack(keys, i, math.min(i + 999, #keys)))
+    end
+    redis.call("DEL", tag)
+end
+return n
+`)
+
+    // pruneScript removes the members of ARGV from the tag set KEYS[1] when their key does not exist
+    pruneScript = newScript(`
+for _, key in ipairs(ARGV) do
+    if redis.call("EXISTS", key) == 0 then
+        redis.call("SREM", KEYS[1], key)
+    end
+end
+return 0
+`)
+
+    // tagQueryScript returns the existing members of the tag sets of the first ARGV[1] KEYS, or of any tag set
+    // when ARGV[1] is 0, that are members of one of the other tag sets of KEYS
+    tagQueryScript = newScript(`
+local nAll = tonumber(ARGV[1])
+local keys
+if nAll > 0 then
+    keys = redis.call("SINTER", unpack(KEYS, 1, nAll))
+else
+    keys = redis.call("SUNION", unpack(KEYS))
+end
+local matched = {}
+for _, key in ipairs(keys) do
+    local tagged = nAll == 0 or nAll == #KEYS
+    local i = nAll + 1
+    while not tagged and i <= #KEYS do
+        tagged = redis.call("SISMEMBER", KEYS[i], key) == 1
+        i = i + 1
+    end
+    if tagged and redis.call("EXISTS", key) == 1 then
+        matched[#matched + 1] = key
+    end
+end
+return matched
+`)
+
+    // invalidateTagsAllScript deletes the members of the intersection of the tag sets of KEYS and removes them from the sets
+    invalidateTagsAllScript = newScript(`
+local keys = redis.call("SINTER", unpack(KEYS))
+for i = 1, #keys, 1000 do
+    local batch = {unpack(keys, i, math.min(i + 999, #keys))}
+    redis.call("DEL", unpack(batch))
+    for _, tag in ipairs(KEYS) do
+        redis.call("SREM", tag, unpack(batch))
+    end
+end
+return #keys
+`)
+
+    // scripts is the registry of the scripts loaded by new caches
+    scripts = []*script{tagScript, incrScript, replaceScript, invalidateTagsScript, pruneScript, tagQueryScript, invalidateTagsAllScript}
+)
+
+// loadScripts loads the registered scripts on the Redis server, or every primary of a cluster.
+// The scripts missing after a failover or a SCRIPT FLUSH are sent by eval when they are first run.
+func (c *redis) loadScripts() {
+    clients := []radix.Client{c.client}
+    if cluster, ok := c.client.(*radix.Cluster); ok {
+        clients = nil
+        for _, node := range cluster.Topo().Primaries() {
+            client, err := cluster.Client(node.Addr)
+            if err != nil {
+                c.onError(fmt.Errorf("loading the Lua scripts on %s: %v", node.Addr, err))
+                continue
+            }
+            clients = append(clients, client)
+        }
+    }
+    for _, client := range clients {
+        for _, s := range scripts {
+            if err := client.Do(radix.Cmd(nil, "SCRIPT", "LOAD", s.src)); err != nil {
+                c.onError(fmt.Errorf("loading the Lua scripts: %v", err))
+                break
+            }
+        }
+    }
+}
+
+// eval runs s with EVALSHA, or with EVAL when the node does not have it which also loads it
+func (c *redis) eval(s *script, rcv interface{}, keys []string, args ...string) error {
+    cmd := append([]string{s.sha, strconv.Itoa(len(keys))}, keys...)
+    err := c.client.Do(radix.Cmd(rcv, "EVALSHA", append(cmd, args...)...))
+    if err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT") {
+        cmd[0] = s.src
+        err = c.client.Do(radix.Cmd(rcv, "EVAL", append(cmd, args...)...))
+    }
+    return err
+}
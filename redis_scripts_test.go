@@ -0,0 +1,43 @@
+package cachita
+
+import (
+    "net"
+    "testing"
+    "time"
+
+    "github.com/mediocregopher/radix/v3"
+    "github.com/stretchr/testify/assert"
+)
+
+func TestRedisScripts(t *testing.T) {
+    t.Parallel()
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    isError(err, t)
+    defer l.Close()
+    s := newFakeRedis(l)
+    c, err := NewRedisCache(time.Hour, 1, "cachita", l.Addr().String())
+    isError(err, t)
+
+    var loaded []string
+    for _, script := range scripts {
+        loaded = append(loaded, "SCRIPT LOAD "+script.src)
+    }
+    assert.Equal(t, loaded, s.commands())
+
+    _, err = c.Incr("n", 0)
+    isError(err, t)
+    assert.Equal(t, "EVALSHA "+incrScript.sha+" 1 cachita:keys::n 3600000", s.commands()[len(loaded)])
+
+    // the scripts are sent again when they were flushed
+    isError(c.(*redis).client.Do(radix.Cmd(nil, "SCRIPT", "FLUSH")), t)
+    _, err = c.Incr("n", 0)
+    isError(err, t)
+    _, err = c.Incr("n", 0)
+    isError(err, t)
+    commands := s.commands()[len(loaded)+2:]
+    assert.Equal(t, []string{
+        "EVALSHA " + incrScript.sha + " 1 cachita:keys::n 3600000",
+        "EVAL " + incrScript.src + " 1 cachita:keys::n 3600000",
+        "EVALSHA " + incrScript.sha + " 1 cachita:keys::n 3600000",
+    }, commands)
+}
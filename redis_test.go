@@ -1,10 +1,14 @@
 package cachita
 
 import (
+    "bytes"
     "os"
+    "reflect"
+    "strings"
     "testing"
     "time"
 
+    "github.com/mediocregopher/radix/v3"
     "github.com/stretchr/testify/assert"
 )
 
@@ -18,6 +22,32 @@ func TestRedisCacheExpires(t *testing.T) {
     cacheExpires(rc(t), t, time.Second, 1200*time.Millisecond)
 }
 
+func TestRedisCacheExpiresMilliseconds(t *testing.T) {
+    t.Parallel()
+    cacheExpires(rc(t), t, 300*time.Millisecond, 400*time.Millisecond)
+}
+
+func TestRedisCacheForever(t *testing.T) {
+    t.Parallel()
+    c := rc(t)
+    cacheForever(c, t)
+    isError(c.Put("redis-forever", 1, Forever), t)
+    var ttl int64
+    isError(c.(*redis).client.Do(radix.Cmd(&ttl, "PTTL", c.(*redis).k("redis-forever"))), t)
+    assert.Equal(t, int64(-1), ttl)
+}
+
+func TestRedisPttl(t *testing.T) {
+    t.Parallel()
+    o, err := newOptions(nil)
+    isError(err, t)
+    c := newRedisCache(time.Second, "cachita", nil, o)
+    assert.Equal(t, int64(1000), c.pttl(0))
+    assert.Equal(t, int64(2), c.pttl(1500*time.Microsecond))
+    assert.Equal(t, int64(1), c.pttl(time.Nanosecond))
+    assert.Equal(t, int64(-1), c.pttl(Forever))
+}
+
 func TestRedisCacheWithInt(t *testing.T) {
     t.Parallel()
     cacheWithInt(rc(t), t)
@@ -58,10 +88,108 @@ func TestRedis_Incr(t *testing.T) {
     cacheIncr(rc(t), t)
 }
 
+func TestRedis_IntegerValues(t *testing.T) {
+    t.Parallel()
+    c := rc(t)
+    var n int64
+    assert.Equal(t, ErrNotFound, c.Get("redis-int-missing", &n))
+
+    isError(c.Put("redis-int", 41, 0), t)
+    isError(c.Get("redis-int", &n), t)
+    assert.Equal(t, int64(41), n)
+    n, err := c.Incr("redis-int", 0)
+    isError(err, t)
+    assert.Equal(t, int64(42), n)
+    var u uint16
+    isError(c.Get("redis-int", &u), t)
+    assert.Equal(t, uint16(42), u)
+}
+
+func TestRedis_EncryptedIntegers(t *testing.T) {
+    t.Parallel()
+    o, err := newOptions([]Option{WithEncryption(EncryptionKey{Id: 1, Key: bytes.Repeat([]byte{1}, 32)})})
+    isError(err, t)
+    c := newRedisCache(time.Hour, "cachita-encrypted", rc(t).(*redis).client, o)
+    isError(c.Put("ssn", 123456789, time.Hour), t)
+    var data string
+    isError(c.client.Do(radix.Cmd(&data, "GET", c.k("ssn"))), t)
+    assert.NotContains(t, data, "123456789")
+    // Incr stores the counter in plain text
+    n, err := c.Incr("ssn", 0)
+    isError(err, t)
+    assert.Equal(t, int64(123456790), n)
+    var ttl int64
+    isError(c.client.Do(radix.Cmd(&ttl, "PTTL", c.k("ssn"))), t)
+    assert.True(t, ttl > 0)
+
+    isError(c.Put("ssn", "v", time.Hour), t)
+    _, err = c.Incr("ssn", 0)
+    assert.Equal(t, errNotInteger, err)
+}
+
+func TestRedisValues(t *testing.T) {
+    t.Parallel()
+    o, err := newOptions([]Option{WithChecksum()})
+    isError(err, t)
+    c := newRedisCache(time.Hour, "cachita", nil, o)
+    for _, v := range []interface{}{int8(-7), uint(53), int64(1) << 40} {
+        data, err := c.encode(v)
+        isError(err, t)
+        var i int64
+        isError(c.decode(data, &i), t)
+        assert.Equal(t, reflect.ValueOf(v).Convert(reflect.TypeOf(i)).Int(), i)
+    }
+    data, err := c.encode("12")
+    isError(err, t)
+    assert.False(t, isDecimal(data))
+    var s string
+    isError(c.decode(data, &s), t)
+    assert.Equal(t, "12", s)
+
+    // named integer types keep their encoding
+    type id int
+    data, err = c.encode(id(12))
+    isError(err, t)
+    assert.False(t, isDecimal(data))
+
+    o, err = newOptions([]Option{WithEncryption(EncryptionKey{Id: 1, Key: bytes.Repeat([]byte{1}, 32)})})
+    isError(err, t)
+    c = newRedisCache(time.Hour, "cachita", nil, o)
+    data, err = c.encode(123456789)
+    isError(err, t)
+    assert.False(t, isDecimal(data))
+    assert.NotContains(t, string(data), "123456789")
+    var i int
+    isError(c.decode(data, &i), t)
+    assert.Equal(t, 123456789, i)
+}
+
 func BenchmarkRedis_Incr(b *testing.B) {
     benchmarkCacheIncr(rc(b), b)
 }
 
+func BenchmarkRedis_IncrEvalSha(b *testing.B) {
+    c := rc(b)
+    b.RunParallel(func(pb *testing.PB) {
+        for pb.Next() {
+            _, err := c.Incr("bench-incr", Forever)
+            isError(err, b)
+        }
+    })
+}
+
+// BenchmarkRedis_IncrNewEvalScript increments as Incr did before the scripts were registered
+func BenchmarkRedis_IncrNewEvalScript(b *testing.B) {
+    c := rc(b).(*redis)
+    b.RunParallel(func(pb *testing.PB) {
+        for pb.Next() {
+            var n int64
+            err := c.client.Do(radix.NewEvalScript(1, incrScript.src).Cmd(&n, c.k("bench-incr"), "-1"))
+            isError(err, b)
+        }
+    })
+}
+
 func rc(t assert.TestingT) (c Cache) {
     h := "127.0.0.1"
     if os.Getenv("REDIS_HOST") != "" {
@@ -76,6 +204,36 @@ func rc(t assert.TestingT) (c Cache) {
     return
 }
 
+func TestRedisNamespace(t *testing.T) {
+    t.Parallel()
+    o, err := newOptions(nil)
+    isError(err, t)
+    cacheNamespace(newRedisCache(time.Hour, "cachita-namespace", rc(t).(*redis).client, o), t)
+}
+
+func TestRedisKeys(t *testing.T) {
+    t.Parallel()
+    o, err := newOptions(nil)
+    isError(err, t)
+    c := newRedisCache(time.Hour, "cachita-keys[1]", rc(t).(*redis).client, o)
+    isError(c.Flush(), t)
+    cacheKeys(c, t)
+}
+
+func TestRedisTagQueries(t *testing.T) {
+    t.Parallel()
+    o, err := newOptions(nil)
+    isError(err, t)
+    c := newRedisCache(time.Hour, "cachita-tag-queries", rc(t).(*redis).client, o)
+    isError(c.Flush(), t)
+    cacheTagQueries(c, t)
+}
+
+func TestRedisTagHierarchy(t *testing.T) {
+    t.Parallel()
+    cacheTagHierarchy(rc(t), t)
+}
+
 func TestRedis_Tag(t *testing.T) {
     t.Parallel()
     cacheTag(rc(t), t)
@@ -84,3 +242,134 @@ func TestRedis_Tag(t *testing.T) {
 func BenchmarkRedis_Tag(b *testing.B) {
     benchmarkCacheTag(rc(b), b)
 }
+
+func TestRedis_TagExpiry(t *testing.T) {
+    t.Parallel()
+    c := rc(t).(*redis)
+    isError(c.Put("tag-expiry:1", "v", 50*time.Millisecond), t)
+    isError(c.Tag("tag-expiry:1", "tag-expiry"), t)
+    // putting the key again with a longer ttl keeps it tagged
+    isError(c.Put("tag-expiry:1", "v", time.Hour), t)
+    time.Sleep(100 * time.Millisecond)
+    var ttl int64
+    isError(c.client.Do(radix.Cmd(&ttl, "PTTL", c.t("tag-expiry"))), t)
+    assert.Equal(t, int64(-1), ttl)
+
+    isError(c.InvalidateTags("tag-expiry"), t)
+    assert.False(t, c.Exists("tag-expiry:1"))
+    var exists bool
+    isError(c.client.Do(radix.Cmd(&exists, "EXISTS", c.t("tag-expiry"))), t)
+    assert.False(t, exists)
+}
+
+func TestRedis_TagPrune(t *testing.T) {
+    t.Parallel()
+    c := rc(t).(*redis)
+    isError(c.Put("prune:1", "v", time.Second), t)
+    isError(c.Put("prune:2", "v", time.Hour), t)
+    isError(c.Tag("prune:1", "prune"), t)
+    isError(c.Tag("prune:2", "prune"), t)
+    time.Sleep(1100 * time.Millisecond)
+    isError(c.prune(), t)
+    var members []string
+    isError(c.client.Do(radix.Cmd(&members, "SMEMBERS", c.t("prune"))), t)
+    assert.Equal(t, []string{c.k("prune:2")}, members)
+}
+
+func TestRedisTagPruneInterval(t *testing.T) {
+    t.Parallel()
+    o, err := newOptions(nil)
+    isError(err, t)
+    assert.Equal(t, time.Hour, o.tagPrune)
+    o, err = newOptions([]Option{WithTagPrune(0)})
+    isError(err, t)
+    assert.Zero(t, o.tagPrune)
+}
+
+func TestRedisClusterKeys(t *testing.T) {
+    t.Parallel()
+    o, err := newOptions(nil)
+    isError(err, t)
+    c := newRedisCache(time.Hour, "{cachita}", nil, o)
+    slot := radix.ClusterSlot([]byte(c.k("user:1")))
+    for _, k := range []string{c.k("user:2"), c.k("{user}:3"), c.t("users"), c.t("*")} {
+        assert.Equal(t, slot, radix.ClusterSlot([]byte(k)), k)
+    }
+    assert.Equal(t, "cachita:keys::user:1", newRedisCache(time.Hour, "cachita", nil, o).k("user:1"))
+}
+
+func TestRedisSpreadKeys(t *testing.T) {
+    t.Parallel()
+    o, err := newOptions([]Option{WithRedisSpreadKeys()})
+    isError(err, t)
+    c := newRedisCache(time.Hour, "cachita", nil, o)
+    c.spread = true
+    assert.NotEqual(t, radix.ClusterSlot([]byte(c.k("user:1"))), radix.ClusterSlot([]byte(c.k("user:2"))))
+    for slot := uint16(0); slot < redisSlots; slot++ {
+        assert.Equal(t, slot, radix.ClusterSlot([]byte(c.st(slot, "users"))))
+    }
+    for _, k := range []string{"user:1", "user:2", "{user}:3"} {
+        slot := radix.ClusterSlot([]byte(c.k(k)))
+        assert.Equal(t, slot, radix.ClusterSlot([]byte(c.st(slot, "users:{1}"))), k)
+    }
+    assert.Equal(t, "cachita:tags:*", c.tPattern())
+    assert.Equal(t, "cachita:slots::users", c.ts("users"))
+    isError(c.InvalidateMulti(), t)
+}
+
+func TestRedisSpreadTags(t *testing.T) {
+    t.Parallel()
+    o, err := newOptions([]Option{WithRedisSpreadKeys()})
+    isError(err, t)
+    c := newRedisCache(time.Hour, "cachita-spread", rc(t).(*redis).client, o)
+    c.spread = true
+    isError(c.Flush(), t)
+    cacheTag(c, t)
+    cacheTagQueries(c, t)
+    cacheTagHierarchy(c, t)
+
+    isError(c.Put("prune:1", "v", time.Second), t)
+    isError(c.Tag("prune:1", "prune"), t)
+    time.Sleep(1100 * time.Millisecond)
+    isError(c.prune(), t)
+    var slots []string
+    isError(c.client.Do(radix.Cmd(&slots, "SMEMBERS", c.ts("prune"))), t)
+    assert.Empty(t, slots)
+}
+
+// TestRedisCluster runs against the cluster nodes listed in REDIS_CLUSTER_ADDRS, separated by commas
+func TestRedisCluster(t *testing.T) {
+    t.Parallel()
+    if os.Getenv("REDIS_CLUSTER_ADDRS") == "" {
+        t.Skip("REDIS_CLUSTER_ADDRS is not set")
+    }
+    c, err := NewRedisClusterCache(time.Hour, "cachita-cluster", strings.Split(os.Getenv("REDIS_CLUSTER_ADDRS"), ","), WithTagPrune(time.Minute))
+    isError(err, t)
+    newCache(c, t)
+    cacheWithInt(c, t)
+    cacheTag(c, t)
+    isError(c.(*redis).prune(), t)
+
+    c, err = NewRedisClusterCache(time.Hour, "cachita-cluster-spread", strings.Split(os.Getenv("REDIS_CLUSTER_ADDRS"), ","), WithRedisSpreadKeys())
+    isError(err, t)
+    cacheTag(c, t)
+    cacheTagQueries(c, t)
+    isError(c.(*redis).prune(), t)
+}
+
+// TestRedisSentinel runs against the sentinels listed in REDIS_SENTINEL_ADDRS monitoring the primary
+// named by REDIS_SENTINEL_PRIMARY
+func TestRedisSentinel(t *testing.T) {
+    t.Parallel()
+    if os.Getenv("REDIS_SENTINEL_ADDRS") == "" {
+        t.Skip("REDIS_SENTINEL_ADDRS is not set")
+    }
+    primary := os.Getenv("REDIS_SENTINEL_PRIMARY")
+    if primary == "" {
+        primary = "mymaster"
+    }
+    c, err := NewRedisSentinelCache(time.Hour, "cachita-sentinel", primary, strings.Split(os.Getenv("REDIS_SENTINEL_ADDRS"), ","))
+    isError(err, t)
+    newCache(c, t)
+    cacheTag(c, t)
+}
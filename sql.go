@@ -1,10 +1,11 @@
 package cachita
 
 import (
+    "context"
     "database/sql"
+    "errors"
     "fmt"
-    "strconv"
-    "strings"
+    "sort"
     "time"
 
     "github.com/vmihailenco/msgpack"
@@ -12,31 +13,60 @@ import (
 
 var sCache Cache
 
+// SqlCache is a Cache stored in a SQL database
+type SqlCache interface {
+    Cache
+    Statter
+    Flusher
+    KeyScanner
+    TagQuerier
+    // Close stops deleting expired rows and closes the prepared statements, it does not close the database
+    Close() error
+    // WithTx returns a view of the cache running its statements in tx, so that its writes are
+    // committed or rolled back with tx
+    WithTx(tx *sql.Tx) Cache
+}
+
+// executor runs statements on a database, a connection or a transaction
+type executor interface {
+    ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+    QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+    QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
 type sqlCache struct {
     db         *sql.DB
+    tx         *sql.Tx
     tableName  string
     ttl        time.Duration
-    isPostgres bool
+    dialect    Dialect
+    codec      *codec
+    sweepBatch int
+    sweepPause time.Duration
+    sweepLock  bool
+    onError    func(err error)
+    stmts      *stmtCache
+    stop       func()
+    metadata   bool
+    // Postgres only
+    sqlUnlogged   bool
+    notifyChannel string
 }
 
 type row struct {
     Id        string
     Value     []byte
+    Counter   sql.NullInt64
     ExpiredAt int64
 }
 
-type tagRow struct {
-    Id   string
-    Keys string
-}
-
 func Sql(driverName, dataSourceName string) (Cache, error) {
     if sCache == nil {
         sqlDriver, err := sql.Open(driverName, dataSourceName)
         if err != nil {
             return nil, err
         }
-        sCache, err = NewSqlCache(24*time.Hour, 5*time.Hour, sqlDriver, "cachita_cache", strings.Contains(dataSourceName, "postgres"))
+        sCache, err = NewSqlCacheWithOptions(24*time.Hour, 5*time.Hour, sqlDriver, "cachita_cache", WithDialect(dialect(driverName, dataSourceName)))
         if err != nil {
             return nil, err
         }
@@ -44,27 +74,77 @@ func Sql(driverName, dataSourceName string) (Cache, error) {
     return sCache, nil
 }
 
+// NewSqlCache creates a MySQL cache, or a Postgres cache when isPostgres is set
 func NewSqlCache(ttl, tickerTtl time.Duration, sql *sql.DB, tableName string, isPostgres ...bool) (Cache, error) {
-    c := &sqlCache{
-        db:        sql,
-        tableName: tableName,
-        ttl:       ttl,
-    }
+    d := MySQL
     if len(isPostgres) > 0 && isPostgres[0] {
-        c.isPostgres = true
+        d = Postgres
     }
-    err := c.createTable()
+    return NewSqlCacheWithOptions(ttl, tickerTtl, sql, tableName, WithDialect(d))
+}
+
+// NewSqlCacheWithOptions creates a cache of the Dialect set WithDialect, MySQL by default
+func NewSqlCacheWithOptions(ttl, tickerTtl time.Duration, sql *sql.DB, tableName string, opts ...Option) (SqlCache, error) {
+    o, err := newOptions(opts)
     if err != nil {
         return nil, err
     }
-
-    runEvery(tickerTtl, func() {
+    c := newSqlCache(sql, tableName, ttl, o)
+    err = c.checkPostgres()
+    if err != nil {
+        return nil, err
+    }
+    err = c.migrate(nil)
+    if err != nil {
+        return nil, err
+    }
+    c.stop = runEvery(tickerTtl, func() {
         c.deleteExpired()
     })
 
     return c, nil
 }
 
+func newSqlCache(db *sql.DB, tableName string, ttl time.Duration, o *options) *sqlCache {
+    return &sqlCache{
+        db:            db,
+        tableName:     tableName,
+        ttl:           ttl,
+        dialect:       o.dialect,
+        codec:         o.codec,
+        sweepBatch:    o.sweepBatch,
+        sweepPause:    o.sweepPause,
+        sweepLock:     o.sweepLock,
+        onError:       o.onError,
+        stmts:         newStmtCache(db),
+        stop:          func() {},
+        metadata:      o.metadata,
+        sqlUnlogged:   o.sqlUnlogged,
+        notifyChannel: o.notifyChannel,
+    }
+}
+
+// WithSweep sets the number of expired SQL rows deleted per transaction and the pause between transactions,
+// the default is 1000 rows every 50ms
+func WithSweep(batch int, pause time.Duration) Option {
+    return func(o *options) {
+        if batch < 1 || pause < 0 {
+            o.err = fmt.Errorf("cachita: invalid sweep of %d rows every %s", batch, pause)
+            return
+        }
+        o.sweepBatch = batch
+        o.sweepPause = pause
+    }
+}
+
+// WithSweepLock makes the SQL caches sharing a table take turns deleting expired rows using an advisory lock,
+// instances skip the sweep while another one holds the lock. SQLite has no advisory locks and always sweeps.
+func WithSweepLock() Option {
+    return func(o *options) {
+        o.sweepLock = true
+    }
+}
+
 func (c *sqlCache) Get(key string, i interface{}) error {
     r, err := c.row(Id(key))
 
@@ -80,79 +160,214 @@ func (c *sqlCache) Get(key string, i interface{}) error {
         return ErrExpired
     }
 
-    return msgpack.Unmarshal(r.Value, i)
+    if r.Counter.Valid {
+        // counters are kept in their own column so they can be incremented by the database
+        var data []byte
+        data, err = msgpack.Marshal(r.Counter.Int64)
+        if err == nil {
+            err = msgpack.Unmarshal(data, i)
+        }
+    } else {
+        err = c.codec.unmarshal(r.Value, i)
+        if err == ErrCorrupt && c.codec.invalidateCorrupt {
+            _ = c.Invalidate(key)
+        }
+    }
+    if err == nil && c.metadata {
+        c.touch(r.Id)
+    }
+    return err
+}
+
+// touch sets the access time of a row, failing to do so does not fail the read
+func (c *sqlCache) touch(id string) {
+    q := c.query().raw("UPDATE ").ident(c.tableName).raw(" SET accessed_at = ").arg(time.Now().Unix()).raw(" WHERE id = ").arg(id)
+    if _, err := c.exec(nil, q.String(), q.args...); err != nil {
+        c.onError(fmt.Errorf("setting the access time of %s: %v", id, err))
+    }
+}
+
+// Stat returns the metadata of the row of key, the key and times are only stored WithMetadata
+func (c *sqlCache) Stat(key string) (m Metadata, err error) {
+    id := Id(key)
+    var (
+        expiredAt int64
+        counter   sql.NullInt64
+    )
+    if !c.metadata {
+        var data []byte
+        q := c.query().raw("SELECT data, counter, expired_at FROM ").ident(c.tableName).raw(" WHERE id = ").arg(id)
+        err = c.queryRow(q.String(), q.args, &data, &counter, &expiredAt)
+        m.Size, m.Codec = int64(len(data)), codecName(data)
+        if counter.Valid {
+            m.Size, m.Codec = 8, counterCodec
+        }
+    } else {
+        var (
+            cacheKey, codec             sql.NullString
+            createdAt, accessedAt, size sql.NullInt64
+        )
+        q := c.query().raw("SELECT cache_key, created_at, accessed_at, size, codec, expired_at FROM ").ident(c.tableName).raw(" WHERE id = ").arg(id)
+        err = c.queryRow(q.String(), q.args, &cacheKey, &createdAt, &accessedAt, &size, &codec, &expiredAt)
+        m.Key, m.Size, m.Codec = cacheKey.String, size.Int64, codec.String
+        m.CreatedAt, m.AccessedAt = unixTime(createdAt), unixTime(accessedAt)
+    }
+    if err == sql.ErrNoRows {
+        return Metadata{}, ErrNotFound
+    }
+    m.ExpiredAt = expiry(time.Unix(expiredAt, 0))
+    return m, err
+}
+
+// unixTime returns the zero time for NULL
+func unixTime(t sql.NullInt64) time.Time {
+    if !t.Valid {
+        return time.Time{}
+    }
+    return time.Unix(t.Int64, 0)
 }
 
 func (c *sqlCache) row(id string) (*row, error) {
     r := new(row)
     r.Id = id
-    query := "SELECT data, expired_at FROM " + c.tableName + " WHERE id = " + c.placeholder(1)
-    err := c.db.QueryRow(query, r.Id).Scan(&r.Value, &r.ExpiredAt)
+    q := c.query().raw("SELECT data, counter, expired_at FROM ").ident(c.tableName).raw(" WHERE id = ").arg(id)
+    err := c.queryRow(q.String(), q.args, &r.Value, &r.Counter, &r.ExpiredAt)
     return r, err
 }
 
+// Put writes integers to the counter column so that Incr increments them, unless the codec encrypts
 func (c *sqlCache) Put(key string, i interface{}, ttl time.Duration) error {
-    r, err := c.row(Id(key))
-    if err != nil && err != sql.ErrNoRows {
-        return err
+    var (
+        data    = []byte{}
+        counter interface{}
+        size    = 8
+        name    = counterCodec
+    )
+    if n, ok := integer(i); ok && !c.codec.encrypts() {
+        counter = n
+    } else {
+        var err error
+        data, err = c.codec.marshal("", i)
+        if err != nil {
+            return err
+        }
+        size, name = len(data), codecName(data)
+    }
+    columns := []string{"id", "data", "counter", "expired_at"}
+    args := []interface{}{Id(key), data, counter, expiredAt(ttl, c.ttl).Unix()}
+    if c.metadata {
+        columns = append(columns, "cache_key", "created_at", "accessed_at", "size", "codec")
+        args = append(args, key, time.Now().Unix(), nil, size, name)
+    }
+    _, err := c.exec(nil, c.dialect.Upsert(c.tableName, []string{"id"}, columns...), args...)
+    return err
+}
+
+// Incr increments the counter column, which is stored in plain text even when the codec encrypts
+func (c *sqlCache) Incr(key string, ttl time.Duration) (n int64, err error) {
+    if c.codec.encrypts() {
+        if err = c.decryptCounter(Id(key)); err != nil {
+            return
+        }
+    }
+    n, err = c.increment(Id(key), ttl)
+    if err != nil || !c.metadata {
+        return
+    }
+    // the increment statements of the dialects only know the columns of the schema
+    q := c.query().raw("UPDATE ").ident(c.tableName).raw(" SET cache_key = ").arg(key).
+        raw(", size = 8, codec = ").arg(counterCodec)
+    if n == 1 {
+        q.raw(", created_at = ").arg(time.Now().Unix())
+    }
+    q.raw(" WHERE id = ").arg(Id(key))
+    _, err = c.exec(nil, q.String(), q.args...)
+    return
+}
+
+// decryptCounter moves an integer encrypted by Put to the counter column so that Incr increments it
+func (c *sqlCache) decryptCounter(id string) error {
+    r, err := c.row(id)
+    if err == sql.ErrNoRows {
+        return nil
     }
-    data, err := msgpack.Marshal(i)
     if err != nil {
         return err
     }
-    var query string
-    if r.Value == nil {
-        query = "INSERT INTO " + c.tableName + " (data, id, expired_at) VALUES(" + c.placeholder(1) + ", " + c.placeholder(2) + ", " + c.placeholder(3) + ")"
-    } else {
-        query = "UPDATE " + c.tableName + " SET data = " + c.placeholder(1) + ", expired_at= " + c.placeholder(3) + " WHERE id = " + c.placeholder(2)
+    if r.Counter.Valid || len(r.Value) == 0 || r.ExpiredAt <= time.Now().Unix() {
+        return nil
     }
-
-    _, err = c.db.Exec(query, data, r.Id, expiredAt(ttl, c.ttl).Unix())
+    var v interface{}
+    if c.codec.unmarshal(r.Value, &v) != nil {
+        return nil
+    }
+    i, ok := integer(v)
+    if !ok {
+        return nil
+    }
+    // the data is compared so that a concurrent Put or Incr is not overwritten
+    q := c.query().raw("UPDATE ").ident(c.tableName).raw(" SET data = ").arg([]byte{}).raw(", counter = ").arg(i).
+        raw(" WHERE id = ").arg(id).raw(" AND counter IS NULL AND data = ").arg(r.Value)
+    _, err = c.exec(nil, q.String(), q.args...)
     return err
 }
 
-func (c *sqlCache) Incr(key string, ttl time.Duration) (int64, error) {
-    var (
-        n   int64
-        exp = expiredAt(ttl, c.ttl).Unix()
-    )
-    r, err := c.row(Id(key))
-    if err != nil && err != sql.ErrNoRows {
-        return 0, err
+func (c *sqlCache) increment(id string, ttl time.Duration) (n int64, err error) {
+    query, last := c.dialect.Incr(c.tableName)
+    args := []interface{}{id, []byte{}, expiredAt(ttl, c.ttl).Unix(), time.Now().Unix()}
+    if last == "" {
+        err = c.queryRow(query, args, &n)
+        return
     }
-
-    if r.Value != nil && time.Unix(r.ExpiredAt, 0).After(time.Now()) {
-        err = msgpack.Unmarshal(r.Value, &n)
-        if err != nil {
-            return 0, err
-        }
-        exp = r.ExpiredAt
+    if c.tx != nil {
+        return c.incr(c.tx, query, last, args)
     }
-    n++
-    data, err := msgpack.Marshal(n)
+
+    // the counter is only available on the connection that incremented it
+    conn, err := c.db.Conn(context.Background())
     if err != nil {
-        return 0, err
+        return
     }
+    defer conn.Close()
+    return c.incr(conn, query, last, args)
+}
 
-    var query string
-    if r.Value == nil {
-        query = "INSERT INTO " + c.tableName + " (data, id, expired_at) VALUES(" + c.placeholder(1) + ", " + c.placeholder(2) + ", " + c.placeholder(3) + ")"
-    } else {
-        query = "UPDATE " + c.tableName + " SET data = " + c.placeholder(1) + ", expired_at= " + c.placeholder(3) + " WHERE id = " + c.placeholder(2)
+func (c *sqlCache) incr(e executor, query, last string, args []interface{}) (n int64, err error) {
+    ctx := context.Background()
+    _, err = e.ExecContext(ctx, query, args...)
+    if err != nil {
+        return
     }
-
-    _, err = c.db.Exec(query, data, r.Id, exp)
-    return n, err
+    err = e.QueryRowContext(ctx, last).Scan(&n)
+    return
 }
 
 func (c *sqlCache) Invalidate(key string) error {
-    _, err := c.db.Exec("DELETE FROM "+c.tableName+" WHERE id = "+c.placeholder(1), Id(key))
-    return err
+    id := Id(key)
+    return c.transaction(func(tx *sql.Tx) error {
+        q := c.query().raw("DELETE FROM ").ident(c.tableName).raw(" WHERE id = ").arg(id)
+        _, err := c.exec(tx, q.String(), q.args...)
+        if err != nil {
+            return err
+        }
+        q = c.query().raw("DELETE FROM ").ident(c.tagsTableName()).raw(" WHERE key_id = ").arg(id)
+        _, err = c.exec(tx, q.String(), q.args...)
+        if err != nil {
+            return err
+        }
+        return c.notify(tx, notifyKey, key)
+    })
+}
+
+// Close stops deleting expired rows and closes the prepared statements shared with the transaction views
+func (c *sqlCache) Close() error {
+    c.stop()
+    return c.stmts.Close()
 }
 
 func (c *sqlCache) Exists(key string) bool {
-    r, _ := c.row(Id(key))
-    if r.Value != nil {
+    r, err := c.row(Id(key))
+    if err == nil {
         expiredAt := time.Unix(r.ExpiredAt, 0)
         if expiredAt.Before(time.Now()) {
             return false
@@ -163,101 +378,337 @@ func (c *sqlCache) Exists(key string) bool {
 }
 
 func (c *sqlCache) deleteExpired() {
-    c.db.Exec("DELETE FROM "+c.tableName+" WHERE expired_at <= "+c.placeholder(1), time.Now().Unix())
+    err := c.sweep()
+    if err != nil {
+        c.onError(fmt.Errorf("deleting expired rows of %s: %v", c.tableName, err))
+    }
 }
 
-func (c *sqlCache) createTable() error {
-    dataColumnType := "blob"
-    if c.isPostgres {
-        dataColumnType = "bytea"
+// sweep deletes the rows expired before it started in batches, pausing between them so that
+// long sweeps do not hold locks on the table
+func (c *sqlCache) sweep() error {
+    ctx := context.Background()
+    if c.sweepLock {
+        conn, err := c.db.Conn(ctx)
+        if err != nil {
+            return err
+        }
+        defer conn.Close()
+        unlock, err := c.lock(ctx, conn, c.tableName+"_sweep", false)
+        if err == errLocked {
+            return nil
+        }
+        if err != nil {
+            return err
+        }
+        defer unlock()
+    }
+
+    now := time.Now().Unix()
+    for {
+        ids, err := c.expiredIds(now)
+        if err != nil {
+            return err
+        }
+        err = c.transaction(func(tx *sql.Tx) error {
+            return chunk(ids, func(ids []interface{}) error {
+                // rows put again since they were selected are kept
+                q := c.query().raw("DELETE FROM ").ident(c.tableName).raw(" WHERE id ").in(ids).raw(" AND expired_at <= ").arg(now)
+                _, err := tx.ExecContext(context.Background(), q.String(), q.args...)
+                if err != nil {
+                    return err
+                }
+                q = c.query().raw("DELETE FROM ").ident(c.tagsTableName()).raw(" WHERE key_id ").in(ids).
+                    raw(" AND NOT EXISTS (SELECT 1 FROM ").ident(c.tableName).raw(" WHERE id = key_id)")
+                _, err = tx.ExecContext(context.Background(), q.String(), q.args...)
+                return err
+            })
+        })
+        if err != nil || len(ids) < c.sweepBatch {
+            return err
+        }
+        time.Sleep(c.sweepPause)
     }
-    _, err := c.db.Exec("CREATE TABLE IF NOT EXISTS " + c.tableName + " (id CHAR(32) NOT NULL PRIMARY KEY, data " + dataColumnType + " NOT NULL, expired_at int NOT NULL)")
+}
+
+func (c *sqlCache) expiredIds(now int64) ([]interface{}, error) {
+    q := c.query().raw("SELECT id FROM ").ident(c.tableName).raw(" WHERE expired_at <= ").arg(now).raw(" " + c.dialect.Limit(c.sweepBatch))
+    return c.selectIds(q)
+}
+
+// selectIds returns the ids selected by q
+func (c *sqlCache) selectIds(q *query) ([]interface{}, error) {
+    rows, err := c.queryRows(q.String(), q.args...)
     if err != nil {
-        return err
+        return nil, err
     }
-    _, err = c.db.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s_tags (id CHAR(32) NOT NULL PRIMARY KEY, keys TEXT NOT NULL)", c.tableName))
-    if err != nil {
-        return err
+    defer rows.Close()
+    var ids []interface{}
+    for rows.Next() {
+        var id string
+        if err := rows.Scan(&id); err != nil {
+            return nil, err
+        }
+        ids = append(ids, id)
     }
-    return nil
+    return ids, rows.Err()
 }
 
-func (c *sqlCache) placeholder(index int) string {
-    if c.isPostgres {
-        return "$" + strconv.Itoa(index)
-    }
-    return "?"
+func (c *sqlCache) query() *query {
+    return newQuery(c.dialect)
+}
+
+// tags are kept in a (tag_id, key_id) join table, the <table>_tags table of older versions is no longer used
+func (c *sqlCache) tagsTableName() string {
+    return c.tableName + "_tag_keys"
 }
 
 func (c *sqlCache) InvalidateMulti(keys ...string) error {
-    var ids []string
+    var ids []interface{}
     for _, key := range keys {
         ids = append(ids, Id(key))
     }
-    _, err := c.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE id IN (%s)", c.tableName, c.placeholder(1)), ids)
-    return err
+    return c.transaction(func(tx *sql.Tx) error {
+        err := chunk(ids, func(ids []interface{}) error {
+            q := c.query().raw("DELETE FROM ").ident(c.tableName).raw(" WHERE id ").in(ids)
+            _, err := tx.ExecContext(context.Background(), q.String(), q.args...)
+            if err != nil {
+                return err
+            }
+            q = c.query().raw("DELETE FROM ").ident(c.tagsTableName()).raw(" WHERE key_id ").in(ids)
+            _, err = tx.ExecContext(context.Background(), q.String(), q.args...)
+            return err
+        })
+        if err != nil {
+            return err
+        }
+        return c.notify(tx, notifyKey, keys...)
+    })
 }
 
-func (c *sqlCache) Tag(key string, tags ...string) (err error) {
+func (c *sqlCache) Tag(key string, tags ...string) error {
     id := Id(key)
-    var r *tagRow
+    query := c.dialect.Upsert(c.tagsTableName(), []string{"tag_id", "key_id"}, "tag_id", "key_id")
     for _, t := range tags {
-        r, err = c.tagRow(Id(t))
-        if err != nil && err != sql.ErrNoRows {
-            return
-        }
-        r.Keys += fmt.Sprintf(",%s", id)
-        var query string
-        if err == sql.ErrNoRows {
-            query = fmt.Sprintf("INSERT INTO %s_tags (keys, id) VALUES(%s, %s)", c.tableName, c.placeholder(1), c.placeholder(2))
-        } else {
-            query = fmt.Sprintf("UPDATE %s_tags SET keys = %s WHERE id = %s ", c.tableName, c.placeholder(1), c.placeholder(2))
-        }
-        _, err = c.db.Exec(query, r.Keys, r.Id)
+        _, err := c.exec(nil, query, Id(t), id)
         if err != nil {
-            return
+            return err
         }
     }
     return nil
 }
 
-func (c *sqlCache) tagRow(id string) (r *tagRow, err error) {
-    r = new(tagRow)
-    r.Id = id
-    query := fmt.Sprintf("SELECT keys FROM %s_tags WHERE id = %s", c.tableName, c.placeholder(1))
-    err = c.db.QueryRow(query, r.Id).Scan(&r.Keys)
-    return
+func (c *sqlCache) InvalidateTags(tags ...string) error {
+    tags = uniqueTags(tags)
+    var ids []interface{}
+    for _, t := range tags {
+        ids = append(ids, Id(t))
+    }
+    return c.transaction(func(tx *sql.Tx) error {
+        err := chunk(ids, func(ids []interface{}) error {
+            q := c.query().raw("DELETE FROM ").ident(c.tableName).
+                raw(" WHERE id IN (SELECT key_id FROM ").ident(c.tagsTableName()).raw(" WHERE tag_id ").in(ids).raw(")")
+            _, err := tx.ExecContext(context.Background(), q.String(), q.args...)
+            if err != nil {
+                return err
+            }
+            // the derived table lets MySQL select from the table it deletes from
+            q = c.query().raw("DELETE FROM ").ident(c.tagsTableName()).
+                raw(" WHERE key_id IN (SELECT key_id FROM (SELECT key_id FROM ").ident(c.tagsTableName()).raw(" WHERE tag_id ").in(ids).raw(") k)")
+            _, err = tx.ExecContext(context.Background(), q.String(), q.args...)
+            return err
+        })
+        if err != nil {
+            return err
+        }
+        return c.notify(tx, notifyTag, tags...)
+    })
 }
 
-func (c *sqlCache) InvalidateTags(tags ...string) (err error) {
-    var keys string
-    var r *tagRow
-    for _, t := range tags {
-        r, err = c.tagRow(Id(t))
-        if err != nil && err != sql.ErrNoRows {
-            return
+// taggedIds appends to q a subquery selecting the ids of the keys tagged with every tag of all and one of any
+func (c *sqlCache) taggedIds(q *query, all, any []string) *query {
+    ids := func(tags []string) []interface{} {
+        var ids []interface{}
+        for _, t := range tags {
+            ids = append(ids, Id(t))
         }
-        if err == sql.ErrNoRows || r == nil {
-            continue
+        return ids
+    }
+    if len(all) == 0 {
+        return q.raw("SELECT key_id FROM ").ident(c.tagsTableName()).raw(" WHERE tag_id ").in(ids(any))
+    }
+    q.raw("SELECT key_id FROM ").ident(c.tagsTableName()).raw(" WHERE tag_id ").in(ids(all))
+    if len(any) > 0 {
+        q.raw(" AND key_id IN (SELECT key_id FROM ").ident(c.tagsTableName()).raw(" WHERE tag_id ").in(ids(any)).raw(")")
+    }
+    return q.raw(" GROUP BY key_id HAVING COUNT(*) = ").arg(len(all))
+}
+
+// KeysByTags joins the tag table to the cache_key column, which is only stored WithMetadata
+func (c *sqlCache) KeysByTags(all, any []string) ([]string, error) {
+    if !c.metadata {
+        return nil, errors.New("cachita: the SQL cache stores its keys WithMetadata")
+    }
+    all, any = uniqueTags(all), uniqueTags(any)
+    if len(all) == 0 && len(any) == 0 {
+        return nil, nil
+    }
+    q := c.query().raw("SELECT k.cache_key FROM ").ident(c.tableName).raw(" k JOIN (")
+    q = c.taggedIds(q, all, any).raw(") t ON t.key_id = k.id WHERE k.expired_at > ").arg(time.Now().Unix())
+    var e executor = c.db
+    if c.tx != nil {
+        e = c.tx
+    }
+    rows, err := e.QueryContext(context.Background(), q.String(), q.args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    var keys []string
+    for rows.Next() {
+        var key string
+        if err := rows.Scan(&key); err != nil {
+            return nil, err
         }
-        keys += fmt.Sprintf(",%s", r.Keys)
+        keys = append(keys, key)
     }
-    s := sqlKeys(keys)
-    _, err = c.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE id IN (%s)", c.tableName, s))
+    sort.Strings(keys)
+    return keys, rows.Err()
+}
 
-    return
+func (c *sqlCache) InvalidateTagsAll(tags ...string) error {
+    tags = uniqueTags(tags)
+    if len(tags) == 0 {
+        return nil
+    }
+    return c.transaction(func(tx *sql.Tx) error {
+        q := c.taggedIds(c.query(), tags, nil)
+        rows, err := tx.QueryContext(context.Background(), q.String(), q.args...)
+        if err != nil {
+            return err
+        }
+        var ids []interface{}
+        for rows.Next() {
+            var id string
+            if err := rows.Scan(&id); err != nil {
+                _ = rows.Close()
+                return err
+            }
+            ids = append(ids, id)
+        }
+        _ = rows.Close()
+        if err := rows.Err(); err != nil {
+            return err
+        }
+        err = chunk(ids, func(ids []interface{}) error {
+            q := c.query().raw("DELETE FROM ").ident(c.tableName).raw(" WHERE id ").in(ids)
+            _, err := tx.ExecContext(context.Background(), q.String(), q.args...)
+            if err != nil {
+                return err
+            }
+            q = c.query().raw("DELETE FROM ").ident(c.tagsTableName()).raw(" WHERE key_id ").in(ids)
+            _, err = tx.ExecContext(context.Background(), q.String(), q.args...)
+            return err
+        })
+        if err != nil {
+            return err
+        }
+        return c.notifyTagsAll(tx, tags)
+    })
 }
-func sqlKeys(s string) string {
-    ids := strings.Split(s, ",")
-    var (
-        l []string
-        r string
-    )
-    for _, v := range ids {
-        if !inArr(l, v) && v != "," && v != "" {
-            l = append(l, v)
-            r += fmt.Sprintf("'%s',", v)
+
+// Keys reads the ids following the last one by batches and matches their keys in Go, like SCAN does, so that
+// each query reads at most a batch of rows. The cache_key column is only stored WithMetadata.
+func (c *sqlCache) Keys(pattern string) KeyIterator {
+    if !c.metadata {
+        return errKeys(errors.New("cachita: the SQL cache stores its keys WithMetadata"))
+    }
+    last := ""
+    return &keyIterator{fetch: func() ([]string, bool, error) {
+        q := c.query().raw("SELECT id, cache_key, expired_at FROM ").ident(c.tableName).
+            raw(" WHERE id > ").arg(last).raw(" ORDER BY id " + c.dialect.Limit(keysBatch))
+        rows, err := c.queryRows(q.String(), q.args...)
+        if err != nil {
+            return nil, false, err
+        }
+        defer rows.Close()
+        now := time.Now().Unix()
+        var keys []string
+        n := 0
+        for rows.Next() {
+            var key string
+            var expiredAt int64
+            if err := rows.Scan(&last, &key, &expiredAt); err != nil {
+                return nil, false, err
+            }
+            n++
+            if expiredAt > now && matchKey(pattern, key) {
+                keys = append(keys, key)
+            }
+        }
+        return keys, n < keysBatch, rows.Err()
+    }}
+}
+
+func (c *sqlCache) InvalidatePattern(pattern string) error {
+    return invalidatePattern(c, pattern)
+}
+
+// Flush deletes the rows of the cache tables by batches of WithSweep, pausing between them as the sweep does
+// so that the tables are not locked for long. The rows written while flushing may be kept.
+func (c *sqlCache) Flush() error {
+    for _, table := range []struct{ name, id string }{{c.tableName, "id"}, {c.tagsTableName(), "key_id"}} {
+        for {
+            q := c.query().raw("SELECT DISTINCT " + table.id + " FROM ").ident(table.name).raw(" " + c.dialect.Limit(c.sweepBatch))
+            ids, err := c.selectIds(q)
+            if err != nil {
+                return err
+            }
+            err = c.transaction(func(tx *sql.Tx) error {
+                return chunk(ids, func(ids []interface{}) error {
+                    q := c.query().raw("DELETE FROM ").ident(c.tableName).raw(" WHERE id ").in(ids)
+                    _, err := tx.ExecContext(context.Background(), q.String(), q.args...)
+                    if err != nil {
+                        return err
+                    }
+                    q = c.query().raw("DELETE FROM ").ident(c.tagsTableName()).raw(" WHERE key_id ").in(ids)
+                    _, err = tx.ExecContext(context.Background(), q.String(), q.args...)
+                    return err
+                })
+            })
+            if err != nil {
+                return err
+            }
+            if len(ids) < c.sweepBatch {
+                break
+            }
+            time.Sleep(c.sweepPause)
         }
     }
-    return strings.TrimRight(r, ",")
+    return c.transaction(func(tx *sql.Tx) error {
+        return c.notify(tx, notifyFlush, "")
+    })
+}
+
+func (c *sqlCache) WithTx(tx *sql.Tx) Cache {
+    v := *c
+    v.tx = tx
+    return &v
+}
+
+// transaction runs f in a new transaction, or in the transaction of the view
+func (c *sqlCache) transaction(f func(tx *sql.Tx) error) error {
+    if c.tx != nil {
+        return f(c.tx)
+    }
+    tx, err := c.db.Begin()
+    if err != nil {
+        return err
+    }
+    err = f(tx)
+    if err != nil {
+        _ = tx.Rollback()
+        return err
+    }
+    return tx.Commit()
 }
@@ -0,0 +1,507 @@
+package cachita
+
+import (
+    "context"
+    "database/sql"
+    "errors"
+    "fmt"
+    "io"
+    "strings"
+)
+
+var errLocked = errors.New("cachita: lock is held by another connection")
+
+// names of the version rows of the cache tables and of the opt-in metadata columns in the <table>_meta table
+const (
+    schema         = "schema"
+    metadataSchema = "metadata"
+    unloggedSchema = "unlogged"
+)
+
+// migration changes the schema of the previous version. Tables created before the schema was versioned
+// start at version 0, so migrations check the state of the tables before changing them.
+type migration func(c *sqlCache, m *migrator) error
+
+var sqlMigrations = []migration{
+    // 1: the cache table as created by the first versions
+    func(c *sqlCache, m *migrator) error {
+        return m.exec(c.createTable(c.tableName, []string{
+            "id CHAR(32) NOT NULL PRIMARY KEY",
+            "data " + c.dialect.BlobType() + " NOT NULL",
+            "expired_at BIGINT NOT NULL",
+        })...)
+    },
+    // 2: counters incremented by the database
+    func(c *sqlCache, m *migrator) error {
+        columns, err := m.columns(c.tableName)
+        if err != nil || columns["counter"] != "" {
+            return err
+        }
+        q := c.query().raw("ALTER TABLE ").ident(c.tableName).raw(" ADD counter BIGINT")
+        return m.exec(q.String())
+    },
+    // 3: expiry times after 2038, the first versions used a 32 bit column
+    func(c *sqlCache, m *migrator) error {
+        columns, err := m.columns(c.tableName)
+        if err != nil || strings.EqualFold(columns["expired_at"], "bigint") {
+            return err
+        }
+        return m.exec(c.dialect.AlterColumn(c.tableName, "expired_at", "BIGINT", true)...)
+    },
+    // 4: the (tag_id, key_id) join table
+    func(c *sqlCache, m *migrator) error {
+        return m.exec(c.createTable(c.tagsTableName(), []string{
+            "tag_id CHAR(32) NOT NULL",
+            "key_id CHAR(32) NOT NULL",
+            "PRIMARY KEY (tag_id, key_id)",
+        }, []string{"key_id"})...)
+    },
+    // 5: the comma separated key ids of the <table>_tags table moved to the join table
+    func(c *sqlCache, m *migrator) error {
+        legacy := c.tableName + "_tags"
+        columns, err := m.columns(legacy)
+        if err != nil || len(columns) == 0 {
+            return err
+        }
+        err = m.run(fmt.Sprintf("copy the tags of %s to %s", legacy, c.tagsTableName()), func(tx executor) error {
+            return c.copyLegacyTags(m.ctx, tx, legacy)
+        })
+        if err != nil {
+            return err
+        }
+        q := c.query().raw("DROP TABLE ").ident(legacy)
+        return m.exec(q.String())
+    },
+    // 6: expired rows are found by the index instead of scanning the table
+    func(c *sqlCache, m *migrator) error {
+        return m.exec(c.dialect.CreateIndex(c.tableName, "expired_at"))
+    },
+    // 7: the integers earlier versions stored in the data column moved to the counter column by
+    // sqlBatchMigrations, so Incr increments them
+    func(c *sqlCache, m *migrator) error {
+        return nil
+    },
+}
+
+// batchMigration moves rows by batches, each committed on its own before the migration of the same version
+// so that large tables are not held by one transaction. It is given the last id of the previous batch and
+// returns the last id of its batch, or an empty id when it is done.
+type batchMigration struct {
+    description string
+    batch       func(c *sqlCache, ctx context.Context, e executor, after string) (last string, err error)
+}
+
+// the batches of sqlMigrations by version, they are run again when their migration fails
+var sqlBatchMigrations = map[int]batchMigration{
+    7: {"move the integers of the data column of %s to the counter column", (*sqlCache).moveLegacyCounters},
+}
+
+// the columns stored WithMetadata
+var metadataMigrations = []migration{
+    // 1: the original key, creation and access times, size and codec of the entries
+    func(c *sqlCache, m *migrator) error {
+        for _, column := range []string{
+            "cache_key TEXT",
+            "created_at BIGINT",
+            "accessed_at BIGINT",
+            "size BIGINT",
+            "codec VARCHAR(64)",
+        } {
+            q := c.query().raw("ALTER TABLE ").ident(c.tableName).raw(" ADD " + column)
+            if err := m.exec(q.String()); err != nil {
+                return err
+            }
+        }
+        return nil
+    },
+}
+
+// the Postgres tables WithUnlogged
+var unloggedMigrations = []migration{
+    // 1: the tables created before WithUnlogged was set are rewritten once
+    func(c *sqlCache, m *migrator) error {
+        for _, table := range []string{c.tableName, c.tagsTableName()} {
+            var persistence string
+            err := m.e.QueryRowContext(m.ctx, "SELECT relpersistence FROM pg_class WHERE oid = to_regclass($1)", c.dialect.Quote(table)).Scan(&persistence)
+            if err == sql.ErrNoRows || persistence == "u" {
+                continue
+            }
+            if err != nil {
+                return err
+            }
+            q := c.query().raw("ALTER TABLE ").ident(table).raw(" SET UNLOGGED")
+            if err := m.exec(q.String()); err != nil {
+                return err
+            }
+        }
+        return nil
+    },
+}
+
+// PlanSqlMigrations writes the statements NewSqlCache would run to bring the cache tables of db up to date to w
+// without running them, steps moving data are written as comments
+func PlanSqlMigrations(w io.Writer, db *sql.DB, tableName string, opts ...Option) error {
+    o, err := newOptions(opts)
+    if err != nil {
+        return err
+    }
+    c := newSqlCache(db, tableName, 0, o)
+    return c.migrate(w)
+}
+
+// migrator runs the statements of migrations or writes them to w for a dry run
+type migrator struct {
+    ctx context.Context
+    e   executor
+    d   Dialect
+    w   io.Writer
+}
+
+func (m *migrator) exec(queries ...string) error {
+    for _, query := range queries {
+        if m.w != nil {
+            if _, err := fmt.Fprintf(m.w, "%s;\n", query); err != nil {
+                return err
+            }
+            continue
+        }
+        if _, err := m.e.ExecContext(m.ctx, query); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// run calls f unless this is a dry run, which writes the description instead
+func (m *migrator) run(description string, f func(e executor) error) error {
+    if m.w != nil {
+        _, err := fmt.Fprintf(m.w, "-- %s\n", description)
+        return err
+    }
+    return f(m.e)
+}
+
+// columns returns the types of the columns of table by name, it is empty when table does not exist
+func (m *migrator) columns(table string) (map[string]string, error) {
+    rows, err := m.e.QueryContext(m.ctx, m.d.Columns(), table)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    columns := make(map[string]string)
+    for rows.Next() {
+        var name, columnType string
+        if err := rows.Scan(&name, &columnType); err != nil {
+            return nil, err
+        }
+        columns[strings.ToLower(name)] = columnType
+    }
+    return columns, rows.Err()
+}
+
+// migrate applies the missing migrations, each in a transaction updating the version, while holding a lock
+// so that only one instance migrates. It writes the statements to w instead when it is set.
+func (c *sqlCache) migrate(w io.Writer) error {
+    ctx := context.Background()
+    conn, err := c.db.Conn(ctx)
+    if err != nil {
+        return err
+    }
+    defer conn.Close()
+
+    if w != nil {
+        return c.plan(ctx, conn, w)
+    }
+    unlock, err := c.lock(ctx, conn, c.metaTableName(), true)
+    if err != nil {
+        return err
+    }
+    defer unlock()
+
+    m := &migrator{ctx: ctx, e: conn, d: c.dialect}
+    if err := m.exec(c.createMetaTable()...); err != nil {
+        return err
+    }
+    query := c.dialect.Upsert(c.metaTableName(), []string{"name"}, "name")
+    for _, t := range c.tracks() {
+        if _, err := conn.ExecContext(ctx, query, t.name); err != nil {
+            return err
+        }
+        version, err := c.version(ctx, conn, t.name)
+        if err != nil {
+            return err
+        }
+        for v := version + 1; v <= len(t.migrations); v++ {
+            err := c.runBatches(ctx, conn, t.batches[v])
+            if err == nil {
+                err = c.migrateTo(ctx, conn, t, v)
+            }
+            if err != nil {
+                return fmt.Errorf("cachita: migrating the %s of %s to version %d: %v", t.name, c.tableName, v, err)
+            }
+        }
+    }
+    return nil
+}
+
+// track is a list of migrations versioned by a row of the <table>_meta table
+type track struct {
+    name       string
+    migrations []migration
+    batches    map[int]batchMigration
+}
+
+// tracks returns the migrations of the cache tables followed by the ones of the opt-in columns
+func (c *sqlCache) tracks() []track {
+    tracks := []track{{schema, sqlMigrations, sqlBatchMigrations}}
+    if c.metadata {
+        tracks = append(tracks, track{metadataSchema, metadataMigrations, nil})
+    }
+    if c.sqlUnlogged {
+        tracks = append(tracks, track{unloggedSchema, unloggedMigrations, nil})
+    }
+    return tracks
+}
+
+// runBatches runs the batches of b until it is done, each in its own transaction
+func (c *sqlCache) runBatches(ctx context.Context, conn *sql.Conn, b batchMigration) error {
+    if b.batch == nil {
+        return nil
+    }
+    last := ""
+    for {
+        tx, err := conn.BeginTx(ctx, nil)
+        if err != nil {
+            return err
+        }
+        last, err = b.batch(c, ctx, tx, last)
+        if err != nil {
+            _ = tx.Rollback()
+            return err
+        }
+        if err = tx.Commit(); err != nil || last == "" {
+            return err
+        }
+    }
+}
+
+func (c *sqlCache) migrateTo(ctx context.Context, conn *sql.Conn, t track, version int) error {
+    tx, err := conn.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    err = func() error {
+        // writing first locks the row, or the database for SQLite, before reading the version
+        q := c.query().raw("UPDATE ").ident(c.metaTableName()).raw(" SET version = version WHERE name = ").arg(t.name)
+        if _, err := tx.ExecContext(ctx, q.String(), q.args...); err != nil {
+            return err
+        }
+        current, err := c.version(ctx, tx, t.name)
+        if err != nil || current >= version {
+            return err
+        }
+        m := &migrator{ctx: ctx, e: tx, d: c.dialect}
+        if err := t.migrations[version-1](c, m); err != nil {
+            return err
+        }
+        q = c.query().raw("UPDATE ").ident(c.metaTableName()).raw(" SET version = ").arg(version).raw(" WHERE name = ").arg(t.name)
+        _, err = tx.ExecContext(ctx, q.String(), q.args...)
+        return err
+    }()
+    if err != nil {
+        _ = tx.Rollback()
+        return err
+    }
+    return tx.Commit()
+}
+
+func (c *sqlCache) plan(ctx context.Context, conn *sql.Conn, w io.Writer) error {
+    m := &migrator{ctx: ctx, e: conn, d: c.dialect, w: w}
+    columns, err := m.columns(c.metaTableName())
+    if err != nil {
+        return err
+    }
+    if len(columns) == 0 {
+        if err := m.exec(c.createMetaTable()...); err != nil {
+            return err
+        }
+    }
+    for _, t := range c.tracks() {
+        version, err := c.version(ctx, conn, t.name)
+        if err != nil {
+            return err
+        }
+        if version >= len(t.migrations) {
+            continue
+        }
+        for v := version + 1; v <= len(t.migrations); v++ {
+            if _, err := fmt.Fprintf(w, "-- %s version %d\n", t.name, v); err != nil {
+                return err
+            }
+            if b, exists := t.batches[v]; exists {
+                if _, err := fmt.Fprintf(w, "-- "+b.description+"\n", c.tableName); err != nil {
+                    return err
+                }
+            }
+            if err := t.migrations[v-1](c, m); err != nil {
+                return err
+            }
+        }
+        // the values are literals since the statements are not run with arguments
+        q := c.query().raw("INSERT INTO ").ident(c.metaTableName()).raw(fmt.Sprintf(" (name, version) VALUES ('%s', %d)", t.name, len(t.migrations)))
+        if version > 0 {
+            q = c.query().raw("UPDATE ").ident(c.metaTableName()).raw(fmt.Sprintf(" SET version = %d WHERE name = '%s'", len(t.migrations), t.name))
+        }
+        if err := m.exec(q.String()); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// version returns the version of a track, 0 when the tables are not versioned
+func (c *sqlCache) version(ctx context.Context, e executor, name string) (version int, err error) {
+    m := &migrator{ctx: ctx, e: e, d: c.dialect}
+    columns, err := m.columns(c.metaTableName())
+    if err != nil || len(columns) == 0 {
+        return
+    }
+    q := c.query().raw("SELECT version FROM ").ident(c.metaTableName()).raw(" WHERE name = ").arg(name)
+    err = e.QueryRowContext(ctx, q.String(), q.args...).Scan(&version)
+    if err == sql.ErrNoRows {
+        err = nil
+    }
+    return
+}
+
+// lock takes the named lock on conn when the dialect has named locks, it returns errLocked when wait is
+// not set and the lock is held by another connection
+func (c *sqlCache) lock(ctx context.Context, conn *sql.Conn, name string, wait bool) (unlock func(), err error) {
+    lock, release := c.dialect.Lock(wait)
+    if lock == "" {
+        return func() {}, nil
+    }
+    name = "cachita:" + Id(name)
+    var ok bool
+    if err = conn.QueryRowContext(ctx, lock, name).Scan(&ok); err != nil {
+        return
+    }
+    if !ok {
+        return nil, errLocked
+    }
+    return func() {
+        _, _ = conn.ExecContext(ctx, release, name)
+    }, nil
+}
+
+func (c *sqlCache) copyLegacyTags(ctx context.Context, e executor, legacy string) error {
+    q := c.query().raw("SELECT id, ").ident("keys").raw(" FROM ").ident(legacy)
+    rows, err := e.QueryContext(ctx, q.String())
+    if err != nil {
+        return err
+    }
+    tags := make(map[string][]string)
+    for rows.Next() {
+        var id, keys string
+        if err := rows.Scan(&id, &keys); err != nil {
+            rows.Close()
+            return err
+        }
+        for _, key := range strings.Split(keys, ",") {
+            if key != "" {
+                tags[id] = append(tags[id], key)
+            }
+        }
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return err
+    }
+
+    query := c.dialect.Upsert(c.tagsTableName(), []string{"tag_id", "key_id"}, "tag_id", "key_id")
+    for tag, keys := range tags {
+        for _, key := range keys {
+            if _, err := e.ExecContext(ctx, query, tag, key); err != nil {
+                return err
+            }
+        }
+    }
+    return nil
+}
+
+// maxIntegerPayload is the size of the largest integer payload of the codec without compression or encryption,
+// its header, a msgpack int64 and a checksum
+const maxIntegerPayload = 2 + 9 + 4
+
+// moveLegacyCounters moves the integers stored in the data column of the rows after an id to the counter column,
+// it only reads the payloads small enough to be integers. Compressed and encrypted payloads are left as they are.
+func (c *sqlCache) moveLegacyCounters(ctx context.Context, e executor, after string) (string, error) {
+    columns, err := (&migrator{ctx: ctx, e: e, d: c.dialect}).columns(c.tableName)
+    if err != nil {
+        return "", err
+    }
+    q := c.query().raw("SELECT id, CASE WHEN counter IS NULL AND LENGTH(data) <= ").arg(maxIntegerPayload).
+        raw(" THEN data END FROM ").ident(c.tableName).raw(" WHERE id > ").arg(after).
+        raw(" ORDER BY id " + c.dialect.Limit(c.sweepBatch))
+    rows, err := e.QueryContext(ctx, q.String(), q.args...)
+    if err != nil {
+        return "", err
+    }
+    counters := make(map[string]int64)
+    last, n := "", 0
+    for rows.Next() {
+        var data []byte
+        if err := rows.Scan(&last, &data); err != nil {
+            rows.Close()
+            return "", err
+        }
+        n++
+        var v interface{}
+        if len(data) == 0 || c.codec.unmarshal(data, &v) != nil {
+            continue
+        }
+        if i, ok := integer(v); ok {
+            counters[last] = i
+        }
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return "", err
+    }
+
+    for id, i := range counters {
+        q := c.query().raw("UPDATE ").ident(c.tableName).raw(" SET data = ").arg([]byte{}).raw(", counter = ").arg(i)
+        if columns["codec"] != "" {
+            q.raw(", size = 8, codec = ").arg(counterCodec)
+        }
+        q.raw(" WHERE id = ").arg(id)
+        if _, err := e.ExecContext(ctx, q.String(), q.args...); err != nil {
+            return "", err
+        }
+    }
+    if n < c.sweepBatch {
+        return "", nil
+    }
+    return last, nil
+}
+
+// createTable creates the cache tables UNLOGGED WithUnlogged, the meta table is always logged so that
+// the versions survive crashes
+func (c *sqlCache) createTable(table string, columns []string, indexes ...[]string) []string {
+    queries := c.dialect.CreateTable(table, columns, indexes...)
+    if c.sqlUnlogged {
+        queries[0] = strings.Replace(queries[0], "CREATE TABLE", "CREATE UNLOGGED TABLE", 1)
+    }
+    return queries
+}
+
+func (c *sqlCache) createMetaTable() []string {
+    return c.dialect.CreateTable(c.metaTableName(), []string{
+        "name VARCHAR(64) NOT NULL PRIMARY KEY",
+        "version INT NOT NULL DEFAULT 0",
+    })
+}
+
+func (c *sqlCache) metaTableName() string {
+    return c.tableName + "_meta"
+}
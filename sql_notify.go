@@ -0,0 +1,187 @@
+package cachita
+
+import (
+    "database/sql"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/lib/pq"
+)
+
+const (
+    notifyKey   = "k:"
+    notifyTag   = "t:"
+    notifyFlush = "f:"
+    // the tags of InvalidateTagsAll are sent as a JSON list
+    notifyTagsAll = "a:"
+)
+
+// Invalidation is a key or a tag invalidated by a SQL cache created WithNotify
+type Invalidation struct {
+    Key string
+    Tag string
+    // TagsAll are the tags of a key invalidated with all of them
+    TagsAll []string
+    // Flush is set when the cache was flushed
+    Flush bool
+    // Lost is set after the listener reconnected, the invalidations notified while it was disconnected are lost
+    Lost bool
+}
+
+// Apply invalidates the key or the tag of the invalidation in c, such as a memory cache in front of the SQL cache.
+// It flushes c when the SQL cache was flushed or invalidations were lost.
+func (i Invalidation) Apply(c Cache) error {
+    switch {
+    case i.Flush || i.Lost:
+        if f, ok := c.(Flusher); ok {
+            return f.Flush()
+        }
+    case i.Key != "":
+        return c.Invalidate(i.Key)
+    case i.Tag != "":
+        return c.InvalidateTags(i.Tag)
+    case len(i.TagsAll) > 0:
+        // invalidating the keys tagged with any of the tags also invalidates the ones tagged with all
+        if q, ok := c.(TagQuerier); ok {
+            return q.InvalidateTagsAll(i.TagsAll...)
+        }
+        return c.InvalidateTags(i.TagsAll...)
+    }
+    return nil
+}
+
+// WithUnlogged creates the Postgres cache tables as UNLOGGED to skip the write-ahead log, they are emptied
+// after a crash and not replicated. Existing tables are rewritten once by a migration.
+func WithUnlogged() Option {
+    return func(o *options) {
+        o.sqlUnlogged = true
+    }
+}
+
+// WithNotify makes the Postgres cache NOTIFY channel of the invalidated keys and tags when the invalidation
+// commits, ListenSql receives them. Keys and tags must be shorter than the 8000 bytes of a payload.
+func WithNotify(channel string) Option {
+    return func(o *options) {
+        o.notifyChannel = channel
+    }
+}
+
+// notify sends the invalidated keys or tags, prefixed by their kind, in tx
+func (c *sqlCache) notify(tx *sql.Tx, prefix string, values ...string) error {
+    if c.notifyChannel == "" {
+        return nil
+    }
+    for _, v := range values {
+        if _, err := c.exec(tx, "SELECT pg_notify($1, $2)", c.notifyChannel, prefix+v); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// notifyTagsAll sends the tags of InvalidateTagsAll in tx
+func (c *sqlCache) notifyTagsAll(tx *sql.Tx, tags []string) error {
+    if c.notifyChannel == "" {
+        return nil
+    }
+    b, err := json.Marshal(tags)
+    if err != nil {
+        return err
+    }
+    return c.notify(tx, notifyTagsAll, string(b))
+}
+
+// checkPostgres returns an error when Postgres features are enabled for another database
+func (c *sqlCache) checkPostgres() error {
+    if _, ok := c.dialect.(postgres); ok || (!c.sqlUnlogged && c.notifyChannel == "") {
+        return nil
+    }
+    return errors.New("cachita: unlogged tables and notifications need Postgres")
+}
+
+// SqlListener receives the invalidations notified by Postgres SQL caches
+type SqlListener struct {
+    l     *pq.Listener
+    done  chan struct{}
+    close sync.Once
+}
+
+// ListenSql calls f with the invalidations notified on channel by Postgres SQL caches created WithNotify,
+// typically to Apply them to a memory cache. It reconnects when the connection is lost, connection
+// errors are reported to the handler set WithErrorHandler.
+func ListenSql(dataSourceName, channel string, f func(i Invalidation), opts ...Option) (*SqlListener, error) {
+    o, err := newOptions(opts)
+    if err != nil {
+        return nil, err
+    }
+    l := pq.NewListener(dataSourceName, time.Second, time.Minute, func(_ pq.ListenerEventType, err error) {
+        if err != nil {
+            o.onError(fmt.Errorf("listening to %s: %v", channel, err))
+        }
+    })
+    err = l.Listen(channel)
+    if err != nil {
+        _ = l.Close()
+        return nil, err
+    }
+    sl := &SqlListener{l: l, done: make(chan struct{})}
+    go sl.run(f)
+    return sl, nil
+}
+
+func (l *SqlListener) run(f func(i Invalidation)) {
+    for {
+        select {
+        case n, ok := <-l.l.Notify:
+            if !ok {
+                return
+            }
+            // a nil notification follows a reconnection
+            if n == nil {
+                f(Invalidation{Lost: true})
+                continue
+            }
+            if i, ok := parseInvalidation(n.Extra); ok {
+                f(i)
+            }
+        case <-time.After(90 * time.Second):
+            // pinging detects connections lost without the listener being told
+            go func() {
+                _ = l.l.Ping()
+            }()
+        case <-l.done:
+            return
+        }
+    }
+}
+
+// Close stops the listener, closing it again does nothing
+func (l *SqlListener) Close() (err error) {
+    l.close.Do(func() {
+        close(l.done)
+        err = l.l.Close()
+    })
+    return
+}
+
+func parseInvalidation(payload string) (Invalidation, bool) {
+    switch {
+    case strings.HasPrefix(payload, notifyKey):
+        return Invalidation{Key: payload[len(notifyKey):]}, true
+    case strings.HasPrefix(payload, notifyTag):
+        return Invalidation{Tag: payload[len(notifyTag):]}, true
+    case strings.HasPrefix(payload, notifyTagsAll):
+        var tags []string
+        if err := json.Unmarshal([]byte(payload[len(notifyTagsAll):]), &tags); err != nil || len(tags) == 0 {
+            return Invalidation{}, false
+        }
+        return Invalidation{TagsAll: tags}, true
+    case payload == notifyFlush:
+        return Invalidation{Flush: true}, true
+    }
+    return Invalidation{}, false
+}
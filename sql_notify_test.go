@@ -0,0 +1,142 @@
+package cachita
+
+import (
+    "database/sql"
+    "testing"
+    "time"
+
+    "github.com/lib/pq"
+    "github.com/stretchr/testify/assert"
+)
+
+func TestSqlListenerClose(t *testing.T) {
+    t.Parallel()
+    l := &SqlListener{l: pq.NewListener("postgres://localhost:1/test", time.Second, time.Minute, nil), done: make(chan struct{})}
+    go l.run(func(Invalidation) {})
+    isError(l.Close(), t)
+    isError(l.Close(), t)
+}
+
+func TestParseInvalidation(t *testing.T) {
+    t.Parallel()
+    i, ok := parseInvalidation("k:users:1")
+    assert.True(t, ok)
+    assert.Equal(t, Invalidation{Key: "users:1"}, i)
+    i, ok = parseInvalidation("t:users")
+    assert.True(t, ok)
+    assert.Equal(t, Invalidation{Tag: "users"}, i)
+    i, ok = parseInvalidation("f:")
+    assert.True(t, ok)
+    assert.Equal(t, Invalidation{Flush: true}, i)
+    i, ok = parseInvalidation(`a:["a","b"]`)
+    assert.True(t, ok)
+    assert.Equal(t, Invalidation{TagsAll: []string{"a", "b"}}, i)
+    _, ok = parseInvalidation("a:[")
+    assert.False(t, ok)
+    _, ok = parseInvalidation("x")
+    assert.False(t, ok)
+}
+
+func TestInvalidationApply(t *testing.T) {
+    t.Parallel()
+    c := NewMemoryCache(time.Hour, time.Hour)
+    isError(c.Put("k1", "v", 0), t)
+    isError(c.Put("k2", "v", 0), t)
+    isError(c.Tag("k2", "t"), t)
+
+    isError(Invalidation{Key: "k1"}.Apply(c), t)
+    assert.False(t, c.Exists("k1"))
+    isError(Invalidation{Tag: "t"}.Apply(c), t)
+    assert.False(t, c.Exists("k2"))
+    isError(c.Put("k4", "v", 0), t)
+    isError(c.Put("k5", "v", 0), t)
+    isError(c.Tag("k4", "a", "b"), t)
+    isError(c.Tag("k5", "a"), t)
+    isError(Invalidation{TagsAll: []string{"a", "b"}}.Apply(c), t)
+    assert.False(t, c.Exists("k4"))
+    assert.True(t, c.Exists("k5"))
+    isError(c.Put("k3", "v", 0), t)
+    isError(Invalidation{Lost: true}.Apply(c), t)
+    assert.False(t, c.Exists("k3"))
+}
+
+func TestSqlite_PostgresOptions(t *testing.T) {
+    t.Parallel()
+    db := sqliteDb(t, "postgres-options")
+    _, err := NewSqlCacheWithOptions(time.Hour, time.Hour, db, "cachita_cache", WithDialect(SQLite), WithUnlogged())
+    assert.Error(t, err)
+    _, err = NewSqlCacheWithOptions(time.Hour, time.Hour, db, "cachita_cache", WithDialect(SQLite), WithNotify("cachita"))
+    assert.Error(t, err)
+}
+
+func TestSqlCacheUnlogged(t *testing.T) {
+    t.Parallel()
+    db, err := sql.Open("postgres", "postgres://postgres@localhost/test?sslmode=disable")
+    isError(err, t)
+    _, err = NewSqlCacheWithOptions(time.Hour, time.Hour, db, "cachita_unlogged", WithDialect(Postgres), WithUnlogged())
+    isError(err, t)
+    var persistence string
+    isError(db.QueryRow("SELECT relpersistence FROM pg_class WHERE relname = 'cachita_unlogged'").Scan(&persistence), t)
+    assert.Equal(t, "u", persistence)
+
+    // existing tables are rewritten once
+    _, err = db.Exec("DROP TABLE IF EXISTS cachita_relogged, cachita_relogged_tag_keys, cachita_relogged_meta")
+    isError(err, t)
+    _, err = NewSqlCacheWithOptions(time.Hour, time.Hour, db, "cachita_relogged", WithDialect(Postgres))
+    isError(err, t)
+    _, err = NewSqlCacheWithOptions(time.Hour, time.Hour, db, "cachita_relogged", WithDialect(Postgres), WithUnlogged())
+    isError(err, t)
+    for _, table := range []string{"cachita_relogged", "cachita_relogged_tag_keys"} {
+        isError(db.QueryRow("SELECT relpersistence FROM pg_class WHERE relname = $1", table).Scan(&persistence), t)
+        assert.Equal(t, "u", persistence, table)
+    }
+}
+
+func TestSqlCacheUnloggedTables(t *testing.T) {
+    t.Parallel()
+    o, err := newOptions([]Option{WithDialect(Postgres), WithUnlogged()})
+    isError(err, t)
+    c := newSqlCache(nil, "c", time.Hour, o)
+    assert.Equal(t, `CREATE UNLOGGED TABLE IF NOT EXISTS "c" (id CHAR(32) NOT NULL PRIMARY KEY)`,
+        c.createTable("c", []string{"id CHAR(32) NOT NULL PRIMARY KEY"})[0])
+    assert.Contains(t, c.createMetaTable()[0], "CREATE TABLE IF NOT EXISTS")
+}
+
+func TestSqlListener(t *testing.T) {
+    t.Parallel()
+    dsn := "postgres://postgres@localhost/test?sslmode=disable"
+    db, err := sql.Open("postgres", dsn)
+    isError(err, t)
+    c, err := NewSqlCacheWithOptions(time.Hour, time.Hour, db, "cachita_notify", WithDialect(Postgres), WithNotify("cachita_test"))
+    isError(err, t)
+
+    received := make(chan Invalidation, 10)
+    l, err := ListenSql(dsn, "cachita_test", func(i Invalidation) {
+        received <- i
+    })
+    isError(err, t)
+    defer l.Close()
+
+    isError(c.Put("k", "v", 0), t)
+    isError(c.Invalidate("k"), t)
+    isError(c.InvalidateTags("t"), t)
+    for _, want := range []Invalidation{{Key: "k"}, {Tag: "t"}} {
+        select {
+        case i := <-received:
+            assert.Equal(t, want, i)
+        case <-time.After(5 * time.Second):
+            t.Fatalf("missing %+v", want)
+        }
+    }
+
+    // notifications of a rolled back transaction are not sent
+    tx, err := db.Begin()
+    isError(err, t)
+    isError(c.WithTx(tx).Invalidate("rolled back"), t)
+    isError(tx.Rollback(), t)
+    select {
+    case i := <-received:
+        t.Fatalf("unexpected %+v", i)
+    case <-time.After(100 * time.Millisecond):
+    }
+}
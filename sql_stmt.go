@@ -0,0 +1,134 @@
+package cachita
+
+import (
+    "context"
+    "database/sql"
+    "errors"
+    "sync"
+)
+
+var errClosed = errors.New("cachita: cache closed")
+
+// stmtCache prepares each statement once and shares it between a cache and its transaction views. The
+// statements of a database are prepared again by database/sql on new connections, so they survive
+// connections being lost, and a statement failing is dropped to be prepared again on next use in case
+// the failure came from the statement itself, such as a plan invalidated by a schema change. Dropped
+// statements are only closed once the calls using them are done.
+type stmtCache struct {
+    db     *sql.DB
+    mu     sync.Mutex
+    stmts  map[string]*cachedStmt
+    closed bool
+}
+
+// cachedStmt counts the calls using the statement
+type cachedStmt struct {
+    *sql.Stmt
+    users   int
+    dropped bool
+}
+
+func newStmtCache(db *sql.DB) *stmtCache {
+    return &stmtCache{db: db, stmts: make(map[string]*cachedStmt)}
+}
+
+// prepare returns the statement of query, it must be released once used
+func (s *stmtCache) prepare(ctx context.Context, query string) (*cachedStmt, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.closed {
+        return nil, errClosed
+    }
+    stmt, exists := s.stmts[query]
+    if !exists {
+        prepared, err := s.db.PrepareContext(ctx, query)
+        if err != nil {
+            return nil, err
+        }
+        stmt = &cachedStmt{Stmt: prepared}
+        s.stmts[query] = stmt
+    }
+    stmt.users++
+    return stmt, nil
+}
+
+// release ends a use of stmt, a failed statement is dropped unless it was already replaced
+func (s *stmtCache) release(query string, stmt *cachedStmt, failed bool) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    stmt.users--
+    if failed && s.stmts[query] == stmt {
+        delete(s.stmts, query)
+        stmt.dropped = true
+    }
+    if stmt.dropped && stmt.users == 0 {
+        _ = stmt.Close()
+    }
+}
+
+// Close closes the statements, the ones in use are closed when they are released
+func (s *stmtCache) Close() (err error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.closed = true
+    for query, stmt := range s.stmts {
+        delete(s.stmts, query)
+        stmt.dropped = true
+        if stmt.users > 0 {
+            continue
+        }
+        if e := stmt.Close(); e != nil && err == nil {
+            err = e
+        }
+    }
+    return
+}
+
+// exec runs a statement prepared once in tx, or in the transaction of the view when tx is nil. Statements
+// built for a number of arguments such as IN lists run unprepared instead.
+func (c *sqlCache) exec(tx *sql.Tx, query string, args ...interface{}) (sql.Result, error) {
+    ctx := context.Background()
+    stmt, err := c.stmts.prepare(ctx, query)
+    if err != nil {
+        return nil, err
+    }
+    r, err := c.txStmt(ctx, tx, stmt.Stmt).ExecContext(ctx, args...)
+    c.stmts.release(query, stmt, err != nil)
+    return r, err
+}
+
+// queryRow runs a statement prepared once and scans its row into dest
+func (c *sqlCache) queryRow(query string, args []interface{}, dest ...interface{}) error {
+    ctx := context.Background()
+    stmt, err := c.stmts.prepare(ctx, query)
+    if err != nil {
+        return err
+    }
+    err = c.txStmt(ctx, nil, stmt.Stmt).QueryRowContext(ctx, args...).Scan(dest...)
+    c.stmts.release(query, stmt, err != nil && err != sql.ErrNoRows)
+    return err
+}
+
+// queryRows runs a statement prepared once, the rows must be closed
+func (c *sqlCache) queryRows(query string, args ...interface{}) (*sql.Rows, error) {
+    ctx := context.Background()
+    stmt, err := c.stmts.prepare(ctx, query)
+    if err != nil {
+        return nil, err
+    }
+    // the rows keep the statement open until they are closed
+    rows, err := c.txStmt(ctx, nil, stmt.Stmt).QueryContext(ctx, args...)
+    c.stmts.release(query, stmt, err != nil)
+    return rows, err
+}
+
+// txStmt returns stmt for tx or the transaction of the view, the returned statement is closed with the transaction
+func (c *sqlCache) txStmt(ctx context.Context, tx *sql.Tx, stmt *sql.Stmt) *sql.Stmt {
+    if tx == nil {
+        tx = c.tx
+    }
+    if tx != nil {
+        return tx.StmtContext(ctx, stmt)
+    }
+    return stmt
+}
@@ -1,13 +1,20 @@
 package cachita
 
 import (
+    "bytes"
+    "context"
     "database/sql"
+    "fmt"
     "os"
+    "path/filepath"
+    "strings"
+    "sync"
     "testing"
     "time"
 
     _ "github.com/lib/pq"
     "github.com/stretchr/testify/assert"
+    _ "modernc.org/sqlite"
 )
 
 func TestNewSqlCache(t *testing.T) {
@@ -89,3 +96,523 @@ func TestSql_Tag(t *testing.T) {
 func BenchmarkSql_Tag(b *testing.B) {
     benchmarkCacheTag(sc(b), b)
 }
+
+var (
+    liteCacheOnce sync.Once
+    liteCache     Cache
+)
+
+func TestSqliteCache(t *testing.T) {
+    t.Parallel()
+    c := lc(t)
+    newCache(c, t)
+    cacheWithInt(c, t)
+    cacheWithString(c, t)
+    cacheWithMapInterface(c, t)
+    cacheWithStruct(c, t)
+}
+
+func TestSqliteCacheExpires(t *testing.T) {
+    t.Parallel()
+    c, err := NewSqlCacheWithOptions(2*time.Minute, time.Second, sqliteDb(t, "expires"), "cachita_cache", WithDialect(SQLite))
+    isError(err, t)
+    cacheExpires(c, t, time.Second, 1200*time.Millisecond)
+}
+
+func TestSqliteCacheForever(t *testing.T) {
+    t.Parallel()
+    c, err := NewSqlCacheWithOptions(time.Millisecond, time.Minute, sqliteDb(t, "forever"), "cachita_cache", WithDialect(SQLite), WithMetadata())
+    isError(err, t)
+    cacheForever(c, t)
+}
+
+func TestSqlite_Incr(t *testing.T) {
+    t.Parallel()
+    cacheIncr(lc(t), t)
+}
+
+func TestSqlite_IntegerValues(t *testing.T) {
+    t.Parallel()
+    c, err := NewSqlCacheWithOptions(time.Hour, time.Hour, sqliteDb(t, "integers"), "cachita_cache", WithDialect(SQLite), WithMetadata())
+    isError(err, t)
+    isError(c.Put("int", int64(5), 0), t)
+    var n int64
+    isError(c.Get("int", &n), t)
+    assert.Equal(t, int64(5), n)
+    n, err = c.Incr("int", 0)
+    isError(err, t)
+    assert.Equal(t, int64(6), n)
+    var u uint16
+    isError(c.Get("int", &u), t)
+    assert.Equal(t, uint16(6), u)
+    m, err := c.Stat("int")
+    isError(err, t)
+    assert.Equal(t, counterCodec, m.Codec)
+
+    // other values are not counters
+    isError(c.Put("int", "5", 0), t)
+    n, err = c.Incr("int", 0)
+    isError(err, t)
+    assert.Equal(t, int64(1), n)
+}
+
+func TestSqlite_EncryptedIntegers(t *testing.T) {
+    t.Parallel()
+    db := sqliteDb(t, "encrypted-integers")
+    key := EncryptionKey{Id: 1, Key: bytes.Repeat([]byte{1}, 32)}
+    c, err := NewSqlCacheWithOptions(time.Hour, time.Hour, db, "cachita_cache", WithDialect(SQLite), WithEncryption(key))
+    isError(err, t)
+    isError(c.Put("ssn", 123456789, 0), t)
+    var (
+        data    []byte
+        counter sql.NullInt64
+    )
+    isError(db.QueryRow("SELECT data, counter FROM cachita_cache WHERE id = ?", Id("ssn")).Scan(&data, &counter), t)
+    assert.False(t, counter.Valid, "integers are encrypted in the data column")
+    assert.NotContains(t, string(data), "123456789")
+    var n int64
+    isError(c.Get("ssn", &n), t)
+    assert.Equal(t, int64(123456789), n)
+
+    // Incr moves the integer to the counter column in plain text
+    n, err = c.Incr("ssn", 0)
+    isError(err, t)
+    assert.Equal(t, int64(123456790), n)
+    isError(c.Get("ssn", &n), t)
+    assert.Equal(t, int64(123456790), n)
+}
+
+func TestSqlite_IncrConcurrent(t *testing.T) {
+    t.Parallel()
+    c := lc(t)
+    k := "concurrent-incr"
+    var wg sync.WaitGroup
+    for n := 0; n < 20; n++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            _, err := c.Incr(k, 0)
+            isError(err, t)
+        }()
+    }
+    wg.Wait()
+
+    var n int
+    isError(c.Get(k, &n), t)
+    assert.Equal(t, 20, n)
+    isError(c.Put(k, "reset", 0), t)
+    i, err := c.Incr(k, 0)
+    isError(err, t)
+    assert.Equal(t, int64(1), i)
+}
+
+func TestSqlite_IncrExpired(t *testing.T) {
+    t.Parallel()
+    c := lc(t)
+    k := "expired-incr"
+    _, err := c.Incr(k, time.Second)
+    isError(err, t)
+    time.Sleep(1100 * time.Millisecond)
+    n, err := c.Incr(k, time.Hour)
+    isError(err, t)
+    assert.Equal(t, int64(1), n)
+    assert.True(t, c.Exists(k))
+}
+
+func BenchmarkSqlite_Incr(b *testing.B) {
+    benchmarkCacheIncr(lc(b), b)
+}
+
+func TestSqlite_Tag(t *testing.T) {
+    t.Parallel()
+    cacheTag(lc(t), t)
+}
+
+func TestSqlite_TagRows(t *testing.T) {
+    t.Parallel()
+    c, err := NewSqlCacheWithOptions(time.Hour, time.Hour, sqliteDb(t, "tags"), "cachita_cache", WithDialect(SQLite))
+    isError(err, t)
+    s := c.(*sqlCache)
+    tagRows := func() (n int) {
+        q := s.query().raw("SELECT COUNT(*) FROM ").ident(s.tagsTableName())
+        isError(s.db.QueryRow(q.String()).Scan(&n), t)
+        return
+    }
+
+    isError(c.Put("k1", "v", 0), t)
+    isError(c.Put("k2", "v", time.Second), t)
+    isError(c.Tag("k1", "t1", "t2"), t)
+    isError(c.Tag("k1", "t1"), t)
+    isError(c.Tag("k2", "t2"), t)
+    assert.Equal(t, 3, tagRows())
+
+    time.Sleep(1100 * time.Millisecond)
+    s.deleteExpired()
+    assert.Equal(t, 2, tagRows(), "tag rows of expired keys should be removed")
+
+    isError(c.InvalidateTags("t1"), t)
+    assert.False(t, c.Exists("k1"))
+    assert.Equal(t, 0, tagRows(), "tag rows of invalidated keys should be removed")
+
+    isError(c.Put("k3", "v", 0), t)
+    isError(c.Tag("k3", "t3"), t)
+    isError(c.Invalidate("k3"), t)
+    assert.Equal(t, 0, tagRows())
+}
+
+func TestSqlite_InvalidateMulti(t *testing.T) {
+    t.Parallel()
+    c, err := NewSqlCacheWithOptions(time.Hour, time.Hour, sqliteDb(t, "multi"), "cachita_cache", WithDialect(SQLite))
+    isError(err, t)
+    s := c.(*sqlCache)
+
+    var keys []string
+    for i := 0; i < 2500; i++ {
+        k := fmt.Sprintf("k%d", i)
+        keys = append(keys, k)
+        isError(c.Put(k, i, 0), t)
+        isError(c.Tag(k, "t"), t)
+    }
+    isError(c.Put("other", "v", 0), t)
+    isError(c.InvalidateMulti(keys...), t)
+
+    for _, k := range []string{"k0", "k999", "k1000", "k2499"} {
+        assert.False(t, c.Exists(k), k)
+    }
+    assert.True(t, c.Exists("other"))
+    var n int
+    q := s.query().raw("SELECT COUNT(*) FROM ").ident(s.tagsTableName())
+    isError(s.db.QueryRow(q.String()).Scan(&n), t)
+    assert.Equal(t, 0, n)
+}
+
+func TestSqlite_QuotedTableName(t *testing.T) {
+    t.Parallel()
+    c, err := NewSqlCacheWithOptions(time.Hour, time.Hour, sqliteDb(t, "quoted"), `cache "table"`, WithDialect(SQLite))
+    isError(err, t)
+    cacheTag(c, t)
+    isError(c.InvalidateMulti("a", "b"), t)
+}
+
+func TestSqlite_Sweep(t *testing.T) {
+    t.Parallel()
+    db := sqliteDb(t, "sweep")
+    c, err := NewSqlCacheWithOptions(time.Hour, time.Hour, db, "cachita_cache", WithDialect(SQLite), WithSweep(2, 0), WithSweepLock())
+    isError(err, t)
+    s := c.(*sqlCache)
+    for i := 0; i < 5; i++ {
+        k := fmt.Sprintf("k%d", i)
+        isError(c.Put(k, i, time.Second), t)
+        isError(c.Tag(k, "t"), t)
+    }
+    isError(c.Put("live", "v", 0), t)
+    isError(c.Tag("live", "t"), t)
+    time.Sleep(1100 * time.Millisecond)
+    isError(s.sweep(), t)
+
+    var rows, tagRows int
+    isError(db.QueryRow("SELECT COUNT(*) FROM cachita_cache").Scan(&rows), t)
+    isError(db.QueryRow("SELECT COUNT(*) FROM cachita_cache_tag_keys").Scan(&tagRows), t)
+    assert.Equal(t, 1, rows)
+    assert.Equal(t, 1, tagRows)
+    assert.True(t, c.Exists("live"))
+}
+
+func TestSqlite_SweepError(t *testing.T) {
+    t.Parallel()
+    db := sqliteDb(t, "sweep-error")
+    var errs []error
+    c, err := NewSqlCacheWithOptions(time.Hour, time.Hour, db, "cachita_cache", WithDialect(SQLite), WithErrorHandler(func(err error) {
+        errs = append(errs, err)
+    }))
+    isError(err, t)
+    isError(db.Close(), t)
+    c.(*sqlCache).deleteExpired()
+    assert.Len(t, errs, 1)
+
+    _, err = NewSqlCacheWithOptions(time.Hour, time.Hour, db, "cachita_cache", WithDialect(SQLite), WithSweep(0, time.Second))
+    assert.Error(t, err)
+}
+
+func TestSqlite_WithTx(t *testing.T) {
+    t.Parallel()
+    db := sqliteDb(t, "tx")
+    c, err := NewSqlCacheWithOptions(time.Hour, time.Hour, db, "cachita_cache", WithDialect(SQLite))
+    isError(err, t)
+    isError(c.Put("k1", "v", 0), t)
+    isError(c.Tag("k1", "t"), t)
+
+    tx, err := db.Begin()
+    isError(err, t)
+    v := c.WithTx(tx)
+    isError(v.Put("k2", "v", 0), t)
+    isError(v.Invalidate("k1"), t)
+    assert.True(t, v.Exists("k2"), "the view should read its own writes")
+    isError(tx.Rollback(), t)
+    assert.True(t, c.Exists("k1"))
+    assert.False(t, c.Exists("k2"))
+
+    tx, err = db.Begin()
+    isError(err, t)
+    v = c.WithTx(tx)
+    isError(v.Put("k2", "v", 0), t)
+    isError(v.InvalidateTags("t"), t)
+    n, err := v.Incr("n", 0)
+    isError(err, t)
+    assert.Equal(t, int64(1), n)
+    isError(tx.Commit(), t)
+    assert.False(t, c.Exists("k1"))
+    assert.True(t, c.Exists("k2"))
+    assert.True(t, c.Exists("n"))
+}
+
+func TestSqlite_PreparedStatements(t *testing.T) {
+    t.Parallel()
+    db := sqliteDb(t, "stmts")
+    c, err := NewSqlCacheWithOptions(time.Hour, time.Hour, db, "cachita_cache", WithDialect(SQLite))
+    isError(err, t)
+    s := c.(*sqlCache)
+    var v string
+    for i := 0; i < 3; i++ {
+        isError(c.Put("k", "v", 0), t)
+        isError(c.Get("k", &v), t)
+        isError(c.Invalidate("k"), t)
+    }
+    assert.Len(t, s.stmts.stmts, 4, "statements should be prepared once")
+
+    // failing statements are prepared again on next use
+    query := `INSERT INTO "cachita_cache_meta" (name) VALUES (?1)`
+    _, err = s.exec(nil, query, "x")
+    isError(err, t)
+    _, err = s.exec(nil, query, "x")
+    assert.Error(t, err)
+    assert.NotContains(t, s.stmts.stmts, query)
+
+    isError(c.Close(), t)
+    assert.Empty(t, s.stmts.stmts)
+    assert.Equal(t, errClosed, c.Get("k", &v))
+}
+
+func TestSqlite_PreparedStatementsConcurrentFailures(t *testing.T) {
+    t.Parallel()
+    c, err := NewSqlCacheWithOptions(time.Hour, time.Hour, sqliteDb(t, "stmts-concurrent"), "cachita_cache", WithDialect(SQLite))
+    isError(err, t)
+    s := c.(*sqlCache)
+    query := `INSERT INTO "cachita_cache_meta" (name) VALUES (?1)`
+    _, err = s.exec(nil, query, "duplicate")
+    isError(err, t)
+
+    // a statement failing in a call must not be closed under the other calls using it
+    stmt, err := s.stmts.prepare(context.Background(), query)
+    isError(err, t)
+    _, err = s.exec(nil, query, "duplicate")
+    assert.Error(t, err)
+    _, err = stmt.Exec("held")
+    isError(err, t)
+    s.stmts.release(query, stmt, false)
+
+    var wg sync.WaitGroup
+    errs := make(chan error, 200)
+    for g := 0; g < 16; g++ {
+        wg.Add(1)
+        go func(g int) {
+            defer wg.Done()
+            for i := 0; i < 25; i++ {
+                if g%2 == 0 {
+                    _, _ = s.exec(nil, query, "duplicate")
+                    continue
+                }
+                if _, err := s.exec(nil, query, fmt.Sprintf("name-%d-%d", g, i)); err != nil {
+                    errs <- err
+                }
+            }
+        }(g)
+    }
+    wg.Wait()
+    close(errs)
+    for err := range errs {
+        assert.NoError(t, err)
+    }
+    isError(c.Close(), t)
+}
+
+func TestSqlite_FlushBatches(t *testing.T) {
+    t.Parallel()
+    c, err := NewSqlCacheWithOptions(time.Hour, time.Hour, sqliteDb(t, "flush"), "cachita_cache", WithDialect(SQLite), WithSweep(7, 0))
+    isError(err, t)
+    for i := 0; i < 30; i++ {
+        k := fmt.Sprintf("k%d", i)
+        isError(c.Put(k, i, 0), t)
+        isError(c.Tag(k, "t"), t)
+    }
+    // tags of keys that were never put
+    isError(c.Tag("missing", "t"), t)
+
+    isError(c.Flush(), t)
+    for _, table := range []string{"cachita_cache", "cachita_cache_tag_keys"} {
+        var n int
+        isError(c.(*sqlCache).db.QueryRow("SELECT COUNT(*) FROM "+table).Scan(&n), t)
+        assert.Equal(t, 0, n, table)
+    }
+}
+
+func TestSqlite_Stat(t *testing.T) {
+    t.Parallel()
+    db := sqliteDb(t, "stat")
+    c, err := NewSqlCacheWithOptions(time.Hour, time.Hour, db, "cachita_cache", WithDialect(SQLite))
+    isError(err, t)
+    isError(c.Put("k", "v", 0), t)
+    m, err := c.Stat("k")
+    isError(err, t)
+    assert.Equal(t, "", m.Key, "keys are only stored with metadata")
+    assert.Equal(t, "msgpack", m.Codec)
+
+    var plan bytes.Buffer
+    isError(PlanSqlMigrations(&plan, db, "cachita_cache", WithDialect(SQLite), WithMetadata()), t)
+    assert.Contains(t, plan.String(), `ALTER TABLE "cachita_cache" ADD cache_key TEXT;`)
+
+    c, err = NewSqlCacheWithOptions(time.Hour, time.Hour, db, "cachita_cache", WithDialect(SQLite), WithMetadata(), WithCompression(Gzip, 0))
+    isError(err, t)
+    _, err = c.Stat("missing")
+    assert.Equal(t, ErrNotFound, err)
+
+    isError(c.Put("k", "v", time.Minute), t)
+    m, err = c.Stat("k")
+    isError(err, t)
+    assert.Equal(t, "k", m.Key)
+    assert.Equal(t, "msgpack+gzip", m.Codec)
+    assert.True(t, m.Size > 0)
+    assert.WithinDuration(t, time.Now(), m.CreatedAt, time.Minute)
+    assert.WithinDuration(t, time.Now().Add(time.Minute), m.ExpiredAt, 2*time.Second)
+    assert.True(t, m.AccessedAt.IsZero())
+
+    var v string
+    isError(c.Get("k", &v), t)
+    m, err = c.Stat("k")
+    isError(err, t)
+    assert.False(t, m.AccessedAt.IsZero())
+
+    _, err = c.Incr("n", 0)
+    isError(err, t)
+    m, err = c.Stat("n")
+    isError(err, t)
+    assert.Equal(t, Metadata{Key: "n", CreatedAt: m.CreatedAt, ExpiredAt: m.ExpiredAt, Size: 8, Codec: counterCodec}, m)
+    assert.False(t, m.CreatedAt.IsZero())
+}
+
+func TestSqlite_Migrate(t *testing.T) {
+    t.Parallel()
+    db := sqliteDb(t, "migrate")
+    c, err := NewSqlCacheWithOptions(time.Hour, time.Hour, db, "cachita_cache", WithDialect(SQLite))
+    isError(err, t)
+    s := c.(*sqlCache)
+    version, err := s.version(context.Background(), db, schema)
+    isError(err, t)
+    assert.Equal(t, len(sqlMigrations), version)
+
+    // opening the migrated tables again is a no-op
+    _, err = NewSqlCacheWithOptions(time.Hour, time.Hour, db, "cachita_cache", WithDialect(SQLite))
+    isError(err, t)
+    var plan bytes.Buffer
+    isError(PlanSqlMigrations(&plan, db, "cachita_cache", WithDialect(SQLite)), t)
+    assert.Empty(t, plan.String())
+}
+
+func TestSqlite_MigrateLegacy(t *testing.T) {
+    t.Parallel()
+    db := sqliteDb(t, "legacy")
+    // the tables created by the first versions
+    for _, query := range []string{
+        "CREATE TABLE cachita_cache (id CHAR(32) NOT NULL PRIMARY KEY, data blob NOT NULL, expired_at int NOT NULL)",
+        `CREATE TABLE cachita_cache_tags (id CHAR(32) NOT NULL PRIMARY KEY, "keys" TEXT NOT NULL)`,
+    } {
+        _, err := db.Exec(query)
+        isError(err, t)
+    }
+    data, err := new(codec).marshal("", "v")
+    isError(err, t)
+    expiry := time.Now().Add(time.Hour).Unix()
+    counter, err := new(codec).marshal("", int64(5))
+    isError(err, t)
+    checksum, err := (&codec{checksum: true}).marshal("", int64(-1)<<40)
+    isError(err, t)
+    long, err := new(codec).marshal("", strings.Repeat("v", 100))
+    isError(err, t)
+    _, err = db.Exec("INSERT INTO cachita_cache VALUES (?, ?, ?), (?, ?, ?), (?, ?, ?), (?, ?, ?), (?, ?, ?)",
+        Id("k1"), data, expiry, Id("k2"), data, expiry, Id("counter"), counter, expiry,
+        Id("checksum"), checksum, expiry, Id("long"), long, expiry)
+    isError(err, t)
+    _, err = db.Exec(`INSERT INTO cachita_cache_tags VALUES (?, ?)`, Id("t"), ","+Id("k1")+","+Id("k2"))
+    isError(err, t)
+
+    var plan bytes.Buffer
+    isError(PlanSqlMigrations(&plan, db, "cachita_cache", WithDialect(SQLite)), t)
+    assert.Contains(t, plan.String(), `ALTER TABLE "cachita_cache" ADD counter BIGINT;`)
+    assert.Contains(t, plan.String(), "-- copy the tags of cachita_cache_tags to cachita_cache_tag_keys")
+    assert.Contains(t, plan.String(), `DROP TABLE "cachita_cache_tags";`)
+    assert.Contains(t, plan.String(), "-- move the integers of the data column of cachita_cache to the counter column")
+
+    // the integers are moved by batches of 2 rows
+    c, err := NewSqlCacheWithOptions(time.Hour, time.Hour, db, "cachita_cache", WithDialect(SQLite), WithSweep(2, 0))
+    isError(err, t)
+    var v string
+    isError(c.Get("k1", &v), t)
+    assert.Equal(t, "v", v)
+    isError(c.Get("long", &v), t)
+    assert.Equal(t, strings.Repeat("v", 100), v)
+    n, err := c.Incr("n", 0)
+    isError(err, t)
+    assert.Equal(t, int64(1), n)
+    // the counters of the first versions keep counting
+    n, err = c.Incr("counter", 0)
+    isError(err, t)
+    assert.Equal(t, int64(6), n)
+    n, err = c.Incr("checksum", 0)
+    isError(err, t)
+    assert.Equal(t, int64(-1)<<40+1, n)
+
+    isError(c.InvalidateTags("t"), t)
+    assert.False(t, c.Exists("k1"))
+    assert.False(t, c.Exists("k2"))
+    _, err = db.Exec("SELECT * FROM cachita_cache_tags")
+    assert.Error(t, err, "the legacy tags table should be dropped")
+}
+
+func TestSqlite_PlanMigrations(t *testing.T) {
+    t.Parallel()
+    db := sqliteDb(t, "plan")
+    var plan bytes.Buffer
+    isError(PlanSqlMigrations(&plan, db, "cachita_cache", WithDialect(SQLite)), t)
+    assert.Contains(t, plan.String(), `CREATE TABLE IF NOT EXISTS "cachita_cache_meta"`)
+    assert.Contains(t, plan.String(), `CREATE TABLE IF NOT EXISTS "cachita_cache" `)
+    assert.Contains(t, plan.String(), fmt.Sprintf(`INSERT INTO "cachita_cache_meta" (name, version) VALUES ('schema', %d);`, len(sqlMigrations)))
+    assert.NotContains(t, plan.String(), "DROP TABLE")
+
+    var n int
+    isError(db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table'").Scan(&n), t)
+    assert.Equal(t, 0, n, "a dry run should not create tables")
+}
+
+func BenchmarkSqlite_Tag(b *testing.B) {
+    benchmarkCacheTag(lc(b), b)
+}
+
+func lc(t assert.TestingT) Cache {
+    liteCacheOnce.Do(func() {
+        var err error
+        liteCache, err = NewSqlCacheWithOptions(24*time.Hour, 5*time.Hour, sqliteDb(t, "cache"), "cachita_cache", WithDialect(SQLite))
+        isError(err, t)
+    })
+    return liteCache
+}
+
+func sqliteDb(t assert.TestingT, name string) *sql.DB {
+    path, err := filepath.Abs(filepath.Dir(os.Args[0]))
+    isError(err, t)
+    path = filepath.Join(path, "tmp-sqlite", name+".db")
+    isError(os.MkdirAll(filepath.Dir(path), os.ModePerm), t)
+    _ = os.Remove(path)
+    db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+    isError(err, t)
+    return db
+}
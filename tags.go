@@ -0,0 +1,70 @@
+package cachita
+
+import (
+    "errors"
+    "sort"
+    "strings"
+)
+
+// TagSeparator joins the levels of the paths of TagPath
+const TagSeparator = "/"
+
+var errNoTagQueries = errors.New("cachita: the cache does not query its tags")
+
+// TagQuerier is implemented by the caches querying their tags
+type TagQuerier interface {
+    // KeysByTags returns the keys that did not expire tagged with every tag of all and with at least one tag
+    // of any. An empty all or any does not filter the keys, no key is returned when both are empty.
+    KeysByTags(all, any []string) ([]string, error)
+    // InvalidateTagsAll invalidates the keys tagged with every tag, InvalidateTags invalidates the keys
+    // tagged with any of them
+    InvalidateTagsAll(tags ...string) error
+}
+
+// matchTags returns the sorted members of the tag sets tagged with every tag of all and one of any
+func matchTags(all, any []string, members func(tag string) []string) []string {
+    all, any = uniqueTags(all), uniqueTags(any)
+    if len(all) == 0 && len(any) == 0 {
+        return nil
+    }
+
+    var matched map[string]bool
+    for _, t := range all {
+        set := make(map[string]bool)
+        for _, m := range members(t) {
+            if matched == nil || matched[m] {
+                set[m] = true
+            }
+        }
+        matched = set
+    }
+    if len(any) > 0 {
+        set := make(map[string]bool)
+        for _, t := range any {
+            for _, m := range members(t) {
+                if matched == nil || matched[m] {
+                    set[m] = true
+                }
+            }
+        }
+        matched = set
+    }
+
+    result := make([]string, 0, len(matched))
+    for m := range matched {
+        result = append(result, m)
+    }
+    sort.Strings(result)
+    return result
+}
+
+// TagPath tags key with the levels of path joined by TagSeparator and with each of their parents, such as "org:1",
+// "org:1/project:5" and "org:1/project:5/page:9", so invalidating a tag invalidates the keys of its descendants.
+// Tag does not split its tags.
+func TagPath(c Cache, key string, path ...string) error {
+    tags := make([]string, 0, len(path))
+    for i := range path {
+        tags = append(tags, strings.Join(path[:i+1], TagSeparator))
+    }
+    return c.Tag(key, tags...)
+}
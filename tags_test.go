@@ -0,0 +1,174 @@
+package cachita
+
+import (
+    "os"
+    "path/filepath"
+    "sort"
+    "testing"
+    "time"
+
+    "github.com/stretchr/testify/assert"
+)
+
+func TestMatchTags(t *testing.T) {
+    t.Parallel()
+    sets := map[string][]string{"a": {"1", "2", "3"}, "b": {"2", "3", "4"}, "c": {"3", "5"}}
+    members := func(tag string) []string {
+        return sets[tag]
+    }
+    assert.Equal(t, []string{"2", "3"}, matchTags([]string{"a", "b"}, nil, members))
+    assert.Equal(t, []string{"1", "2", "3", "5"}, matchTags(nil, []string{"a", "c"}, members))
+    assert.Equal(t, []string{"2", "3"}, matchTags([]string{"b"}, []string{"a", "c"}, members))
+    assert.Equal(t, []string{"3"}, matchTags([]string{"b"}, []string{"c"}, members))
+    assert.Empty(t, matchTags([]string{"a", "missing"}, nil, members))
+    assert.Empty(t, matchTags(nil, nil, members))
+}
+
+func TestTagPath(t *testing.T) {
+    t.Parallel()
+    c := NewMemoryCache(time.Hour, time.Hour).(*memory)
+    isError(TagPath(c, "page:9", "org:1", "project:5", "page:9"), t)
+    isError(c.Tag("project:6", "org:1/project:6"), t)
+    var tags []string
+    for tag := range c.tags {
+        tags = append(tags, tag)
+    }
+    sort.Strings(tags)
+    assert.Equal(t, []string{"org:1", "org:1/project:5", "org:1/project:5/page:9", "org:1/project:6"}, tags)
+}
+
+func TestMemoryTagQueries(t *testing.T) {
+    t.Parallel()
+    cacheTagQueries(NewMemoryCache(time.Hour, time.Hour), t)
+}
+
+func TestMemoryTagHierarchy(t *testing.T) {
+    t.Parallel()
+    cacheTagHierarchy(NewMemoryCache(time.Hour, time.Hour), t)
+}
+
+func TestFileTagHierarchy(t *testing.T) {
+    t.Parallel()
+    path, err := filepath.Abs(filepath.Dir(os.Args[0]))
+    isError(err, t)
+    path = filepath.Join(path, "tmp19/file-cache")
+    isError(os.RemoveAll(path), t)
+    c, err := NewFileCache(path, time.Hour, 0)
+    isError(err, t)
+    cacheTagHierarchy(c, t)
+}
+
+func TestSqliteTagHierarchy(t *testing.T) {
+    t.Parallel()
+    c, err := NewSqlCacheWithOptions(time.Hour, time.Hour, sqliteDb(t, "tag-hierarchy"), "cachita_cache", WithDialect(SQLite))
+    isError(err, t)
+    cacheTagHierarchy(c, t)
+}
+
+func TestNamespaceTagHierarchy(t *testing.T) {
+    t.Parallel()
+    c, err := NewSqlCacheWithOptions(time.Hour, time.Hour, sqliteDb(t, "namespace-tag-hierarchy"), "cachita_cache", WithDialect(SQLite))
+    isError(err, t)
+    isError(c.Put("page:9", "outside", 0), t)
+    isError(TagPath(c, "page:9", "org:1", "project:5", "page:9"), t)
+    n, err := Namespace(c, "site/1")
+    isError(err, t)
+    cacheTagHierarchy(n, t)
+    assert.True(t, c.Exists("page:9"))
+}
+
+func TestFileTagQueries(t *testing.T) {
+    t.Parallel()
+    path, err := filepath.Abs(filepath.Dir(os.Args[0]))
+    isError(err, t)
+    path = filepath.Join(path, "tmp18/file-cache")
+    isError(os.RemoveAll(path), t)
+    c, err := NewFileCache(path, time.Hour, 0)
+    isError(err, t)
+    cacheTagQueries(c, t)
+}
+
+func TestSqliteTagQueries(t *testing.T) {
+    t.Parallel()
+    c, err := NewSqlCacheWithOptions(time.Hour, time.Hour, sqliteDb(t, "tag-queries"), "cachita_cache", WithDialect(SQLite), WithMetadata())
+    isError(err, t)
+    cacheTagQueries(c, t)
+}
+
+func TestNamespaceTagQueries(t *testing.T) {
+    t.Parallel()
+    c, err := NewSqlCacheWithOptions(time.Hour, time.Hour, sqliteDb(t, "namespace-tag-queries"), "cachita_cache", WithDialect(SQLite), WithMetadata())
+    isError(err, t)
+    isError(c.Put("post:1", "outside", 0), t)
+    isError(c.Tag("post:1", "posts", "user:1"), t)
+    n, err := Namespace(c, "blog")
+    isError(err, t)
+    cacheTagQueries(n, t)
+    assert.True(t, c.Exists("post:1"))
+}
+
+func cacheTagQueries(c Cache, t *testing.T) {
+    q := c.(TagQuerier)
+    for k, tags := range map[string][]string{
+        "post:1": {"posts", "user:1"},
+        "post:2": {"posts", "user:2"},
+        "post:3": {"posts", "user:1", "draft"},
+        "user:1": {"user:1"},
+    } {
+        isError(c.Put(k, k, 0), t)
+        isError(c.Tag(k, tags...), t)
+    }
+    isError(c.Put("post:4", "expired", time.Millisecond), t)
+    isError(c.Tag("post:4", "posts", "user:1"), t)
+    time.Sleep(5 * time.Millisecond)
+
+    keys, err := q.KeysByTags([]string{"posts", "user:1"}, nil)
+    isError(err, t)
+    assert.Equal(t, []string{"post:1", "post:3"}, keys)
+    keys, err = q.KeysByTags(nil, []string{"user:2", "draft"})
+    isError(err, t)
+    assert.Equal(t, []string{"post:2", "post:3"}, keys)
+    keys, err = q.KeysByTags([]string{"posts"}, []string{"user:2", "draft"})
+    isError(err, t)
+    assert.Equal(t, []string{"post:2", "post:3"}, keys)
+    keys, err = q.KeysByTags(nil, nil)
+    isError(err, t)
+    assert.Empty(t, keys)
+
+    isError(q.InvalidateTagsAll("posts", "user:1"), t)
+    assert.False(t, c.Exists("post:1"))
+    assert.False(t, c.Exists("post:3"))
+    assert.True(t, c.Exists("post:2"))
+    assert.True(t, c.Exists("user:1"))
+    keys, err = q.KeysByTags(nil, []string{"user:1"})
+    isError(err, t)
+    assert.Equal(t, []string{"user:1"}, keys)
+
+    isError(c.InvalidateTags("posts"), t)
+    assert.False(t, c.Exists("post:2"))
+}
+
+func cacheTagHierarchy(c Cache, t *testing.T) {
+    for k, path := range map[string][]string{
+        "page:9":    {"org:1", "project:5", "page:9"},
+        "page:10":   {"org:1", "project:5", "page:10"},
+        "project:6": {"org:1", "project:6"},
+        "org:2":     {"org:2", "project:7"},
+    } {
+        isError(c.Put(k, k, 0), t)
+        isError(TagPath(c, k, path...), t)
+    }
+    // Tag does not tag the parents
+    isError(c.Put("project:8", "project:8", 0), t)
+    isError(c.Tag("project:8", "org:1/project:8"), t)
+
+    isError(c.InvalidateTags("org:1/project:5"), t)
+    assert.False(t, c.Exists("page:9"))
+    assert.False(t, c.Exists("page:10"))
+    assert.True(t, c.Exists("project:6"))
+
+    isError(c.InvalidateTags("org:1"), t)
+    assert.False(t, c.Exists("project:6"))
+    assert.True(t, c.Exists("org:2"))
+    assert.True(t, c.Exists("project:8"))
+}